@@ -115,7 +115,7 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		tinfo = *info
 	}
-	fmt.Printf("%+v\n", tinfo, err)
+	fmt.Printf("%+v %v\n", tinfo, err)
 	p := (*[infoSize]byte)(unsafe.Pointer(&tinfo))[:]
 	fmt.Println(p)
 	w.Write(p)
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"hash"
 	"hash/crc32"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	h "github.com/qiniu/httpping/http"
@@ -16,24 +29,83 @@ import (
 
 func main() {
 	url := flag.String("u", "www.baidu.com", "ping url")
+	method := flag.String("X", http.MethodGet, "request method")
+	data := flag.String("d", "", "request body, @file reads a file and - reads stdin")
 	ping := flag.Bool("p", true, "with system ping command")
-	local := flag.String("l", "", "local address")
+	pingCount := flag.Int("pc", 1, "echoes of the system ping, a second apart")
+	local := flag.String("l", "", "local address or interface name")
+	localPorts := flag.String("local-ports", "", "local port or port range to bind, like 40000-40100")
 	range_ := flag.String("r", "", "http range")
+	ranges := flag.String("ranges", "", "comma separated ranges requested in turn on one connection")
 	server := flag.Bool("s", false, "server support tcpinfo return")
-	hashStr := flag.String("hash", "", "body hash")
+	hashStr := flag.String("hash", "", "body hash, md5, sha1, sha256 or crc")
+	expectHash := flag.String("expect", "", "expected hex body hash, sha256 unless -hash is given")
 	ua := flag.String("ua", "", "user agent")
+	success := flag.String("success", "", "comma separated expected status codes, 2xx when empty, a listed redirect is not followed")
+	retryOn := flag.String("retry-on", "", "comma separated status codes to retry the request on, e.g. 502,503,504")
+	retries := flag.Int("retries", 3, "retries with -retry-on")
+	retryBackoff := flag.Int64("retry-backoff", 1000, "wait before the first retry, doubling after, ms")
 	redirect := flag.Bool("redirect", false, "enable redirect")
+	maxRedirects := flag.Int("max-redirects", 10, "redirects followed with -redirect, 0 makes any redirect an error")
 	timeout := flag.Int64("timeout", 10, "total timeout, seconds")
+	connectTimeout := flag.Int64("connect-timeout", 1000, "tcp connect timeout, ms")
+	readTimeout := flag.Int64("read-timeout", 0, "response timeout from the request sent, ms, 0 for none")
+	waitClose := flag.Int64("wait-close", 0, "wait this long after the body for the server to close, ms")
+	maxConn := flag.Int64("max-conn-duration", 0, "close the connection once it is this old, ms, 0 for no limit")
 	ip := flag.String("ip", "", "server ip")
+	resolve := flag.String("resolve", "", "comma separated host:port:ip to use instead of DNS, like curl --resolve")
+	tos := flag.Int("tos", 0, "ip tos byte, dscp << 2, e.g. 184 for EF")
+	pcap := flag.String("pcap", "", "capture the connection with tcpdump into this pcap file")
+	envProxy := flag.Bool("env-proxy", false, "use the proxy of HTTP_PROXY, HTTPS_PROXY and NO_PROXY")
+	doh := flag.String("doh", "", "resolve over DNS-over-HTTPS with this json endpoint, e.g. https://dns.google/resolve")
+	sni := flag.String("sni", "", "tls server name, the host of the url when empty")
 	verifyHost := flag.Bool("verify", true, "verify host cert")
+	denyReserved := flag.Bool("deny-reserved", false, "refuse private, loopback and other reserved addresses")
+	handshake := flag.Bool("handshake", false, "only connect, plus the tls handshake for https, send no request")
+	parallel := flag.Int("parallel", 0, "download the body by ranges over this many connections at once")
+	sweep := flag.String("ports", "", "only connect to these ports of the host, like 22,80,8000-8010, and report which are open")
+	resume := flag.Bool("resume", false, "ping https twice and compare the full and the resumed tls handshake")
+	count := flag.Int("c", 1, "ping count, a summary is printed when more than one")
+	continuous := flag.Bool("continuous", false, "ping until interrupted, printing each ping and a summary every -summary-every pings")
+	summaryEvery := flag.Int("summary-every", 10, "pings between the rolling summaries of -continuous, 0 for none")
+	interval := flag.Int64("i", 1000, "interval between pings, ms")
+	jitter := flag.Int64("interval-jitter", 0, "randomize each interval by up to this much either way, ms")
+	buckets := flag.String("buckets", "", "comma separated histogram bounds for the summary, ms")
+	verbose := flag.Bool("v", false, "print a timing waterfall instead of json")
+	debug := flag.Bool("debug", false, "print the raw socket events of the ping to stderr")
+	fieldName := flag.String("field", "", "print only this numeric field, e.g. ttfb, connect, speed")
+	allIps := flag.Bool("all", false, "ping every resolved ip")
+	encoding := flag.String("encoding", "", "accept encoding, identity disables compression")
+	http10 := flag.Bool("http1.0", false, "send the request as HTTP/1.0")
+	certFile := flag.String("cert", "", "client certificate file for mutual tls")
+	keyFile := flag.String("key", "", "client key file for mutual tls")
+	caFile := flag.String("cacert", "", "ca bundle to verify the server with")
+	happyEyeballs := flag.Bool("happy", false, "race ipv6 and ipv4 like a dual stack client")
+	bufSize := flag.Int("buffer", h.DefaultReadBufferSize, "body read buffer size, bytes")
 	flag.Parse()
 
-	req, err := http.NewRequest(http.MethodGet, *url, nil)
+	// all but a single ping send the request more than once
+	again := *count > 1 || *continuous || *allIps || *resume || *parallel > 0 || *ranges != "" || *retryOn != ""
+	body, length, err := requestBody(*data, again)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	u, err := h.ParseURL(*url)
+	if err != nil {
+		fmt.Println(err)
+		flag.PrintDefaults()
+		return
+	}
+	req, err := http.NewRequest(*method, u.String(), body)
 	if err != nil {
 		fmt.Println(err)
 		flag.PrintDefaults()
 		return
 	}
+	if length >= 0 {
+		req.ContentLength = length
+	}
 	if *range_ != "" {
 		req.Header.Set("Range", "bytes="+*range_)
 	}
@@ -46,26 +118,342 @@ func main() {
 		hasher = md5.New()
 	case "sha1":
 		hasher = sha1.New()
+	case "sha256":
+		hasher = sha256.New()
 	case "crc":
 		hasher = crc32.NewIEEE()
 	}
 
+	var clientCert *tls.Certificate
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		clientCert = &cert
+	}
+	var rootCAs *x509.CertPool
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			fmt.Println("no certificate found in", *caFile)
+			return
+		}
+	}
+
+	successCodes := codes(*success)
+	var portFrom, portTo int
+	if *localPorts != "" {
+		from, to, _ := strings.Cut(*localPorts, "-")
+		portFrom, err = strconv.Atoi(from)
+		if err == nil && to != "" {
+			portTo, err = strconv.Atoi(to)
+		}
+		if err != nil {
+			fmt.Println("bad local port range", *localPorts)
+			return
+		}
+	}
+	overrides, err := resolveOverrides(*resolve)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
 	p := h.Pinger{
-		Req:           req,
-		SysPing:       *ping,
-		SrcAddr:       *local,
-		ServerSupport: *server,
-		BodyHasher:    hasher,
-		Redirect:      *redirect,
-		Timeout:       time.Duration(*timeout) * time.Second,
-		ServerIp:      *ip,
-		VerifyHost:    *verifyHost,
+		Req:              req,
+		SysPing:          *ping,
+		SrcAddr:          *local,
+		ServerSupport:    *server,
+		BodyHasher:       hasher,
+		Redirect:         *redirect,
+		MaxRedirects:     *maxRedirects,
+		DenyRedirect:     *maxRedirects == 0,
+		Timeout:          time.Duration(*timeout) * time.Second,
+		ServerIp:         *ip,
+		VerifyHost:       *verifyHost,
+		ReadBufferSize:   *bufSize,
+		AcceptEncoding:   *encoding,
+		Http10:           *http10,
+		ClientCert:       clientCert,
+		RootCAs:          rootCAs,
+		HappyEyeballs:    *happyEyeballs,
+		ConnectTimeout:   time.Duration(*connectTimeout) * time.Millisecond,
+		ReadTimeout:      time.Duration(*readTimeout) * time.Millisecond,
+		DenyReserved:     *denyReserved,
+		DohUrl:           *doh,
+		EnvProxy:         *envProxy,
+		Tos:              *tos,
+		MaxConnDuration:  time.Duration(*maxConn) * time.Millisecond,
+		PcapFile:         *pcap,
+		ExpectedHash:     *expectHash,
+		ResolveOverrides: overrides,
+		PingCount:        *pingCount,
+		SuccessCodes:     successCodes,
+		ServerName:       *sni,
+		WaitClose:        time.Duration(*waitClose) * time.Millisecond,
+		RetryCodes:       codes(*retryOn),
+		Retries:          *retries,
+		RetryBackoff:     time.Duration(*retryBackoff) * time.Millisecond,
+		LocalPortFrom:    portFrom,
+		LocalPortTo:      portTo,
+	}
+	if *debug {
+		p.Debug = &h.Debug{}
+		defer func() {
+			fmt.Fprintln(os.Stderr, p.Debug.String())
+		}()
+	}
+	if *handshake {
+		info, err := p.PingHandshake()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(info.String())
+		return
+	}
+	if *sweep != "" {
+		ports, err := portList(*sweep)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		times, err := p.PingPorts(ports)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		t, _ := json.MarshalIndent(times, "", "	")
+		fmt.Println(string(t))
+		return
+	}
+	if *parallel > 0 {
+		r, err := p.PingParallel(*parallel)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(r.String())
+		return
+	}
+	if *resume {
+		r, err := p.PingResumption()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		t, _ := json.MarshalIndent(r, "", "	")
+		fmt.Println(string(t))
+		return
+	}
+	if *ranges != "" {
+		times, err := p.PingRanges(strings.Split(*ranges, ","))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		t, _ := json.MarshalIndent(times, "", "	")
+		fmt.Println(string(t))
+		return
+	}
+	if *count > 1 || *continuous {
+		r := h.Repeater{
+			Pinger:   p,
+			Count:    *count,
+			Interval: time.Duration(*interval) * time.Millisecond,
+			Jitter:   time.Duration(*jitter) * time.Millisecond,
+		}
+		for _, b := range strings.Split(*buckets, ",") {
+			if v, err := strconv.ParseUint(b, 10, 32); err == nil {
+				r.Buckets = append(r.Buckets, uint32(v))
+			}
+		}
+		if *continuous {
+			r.Count = 0
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			p.Req = p.Req.WithContext(ctx)
+			r.Pinger = p
+			stats := r.Run(ctx, func(info *h.Info, stats *h.Stats) {
+				fmt.Println(line(stats.Count, info))
+				if *summaryEvery > 0 && stats.Count%*summaryEvery == 0 {
+					fmt.Println(summary(stats))
+				}
+			})
+			fmt.Println(stats.String())
+			return
+		}
+		fmt.Println(r.Do().String())
+		return
+	}
+	if *allIps {
+		infos, err := p.PingAllIPs()
+		for _, info := range infos {
+			fmt.Println(info.String())
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
 	}
 	info, err := p.Ping()
 	if err != nil {
 		fmt.Println(err)
 		flag.PrintDefaults()
+		if *fieldName != "" {
+			os.Exit(1)
+		}
+		return
+	}
+	if *fieldName != "" {
+		v, ok := field(info, *fieldName)
+		if !ok {
+			fmt.Fprintln(os.Stderr, "unknown numeric field", *fieldName)
+			os.Exit(2)
+		}
+		fmt.Println(v)
+		if info.Error != "" {
+			fmt.Fprintln(os.Stderr, info.Error)
+			os.Exit(1)
+		}
+		return
+	}
+	if *verbose {
+		fmt.Print(info.Waterfall())
 		return
 	}
 	fmt.Println(info.String())
 }
+
+// requestBody opens the -d body, its length is -1 when unknown,
+// like a pipe on stdin, and the body is then sent chunked. A body
+// sent again is read into memory, a stream is gone once sent.
+func requestBody(data string, again bool) (io.Reader, int64, error) {
+	var f *os.File
+	switch {
+	case data == "":
+		return nil, 0, nil
+	case data == "-":
+		f = os.Stdin
+	case strings.HasPrefix(data, "@"):
+		var err error
+		f, err = os.Open(data[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+	default:
+		return strings.NewReader(data), int64(len(data)), nil
+	}
+	if again {
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return nil, 0, err
+		}
+		// http.NewRequest can open a bytes.Reader again
+		return bytes.NewReader(b), int64(len(b)), nil
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return f, -1, nil
+	}
+	return f, fi.Size(), nil
+}
+
+// line is one ping of -continuous, like a reply line of the system ping.
+func line(seq int, info *h.Info) string {
+	if info.Error != "" && info.Code == 0 {
+		return fmt.Sprintf("seq=%d %s error: %s", seq, info.Ip, info.Error)
+	}
+	s := fmt.Sprintf("seq=%d %s code=%d dns=%dms connect=%dms tls=%dms ttfb=%dms total=%dms size=%d",
+		seq, info.Ip, info.Code, info.DnsTimeMs, info.ConnectTimeMs, info.TLSHandshakeTimeMs,
+		info.TtfbMs, info.TotalTimeMs, info.TotalSize)
+	if info.Error != "" {
+		s += " error: " + info.Error
+	}
+	return s
+}
+
+// summary is the rolling summary of -continuous.
+func summary(stats *h.Stats) string {
+	t := stats.TotalTimeMs
+	return fmt.Sprintf("--- %d pings, %d errors, ttfb avg %.1fms p95 %.0fms, total min/avg/max/p95 %.0f/%.1f/%.0f/%.0fms",
+		stats.Count, stats.Errors, stats.TtfbMs.Avg, stats.TtfbMs.P95, t.Min, t.Avg, t.Max, t.P95)
+}
+
+// codes parses comma separated status codes, skipping what is not a number.
+func codes(s string) []int {
+	var codes []int
+	for _, c := range strings.Split(s, ",") {
+		if v, err := strconv.Atoi(c); err == nil {
+			codes = append(codes, v)
+		}
+	}
+	return codes
+}
+
+// portList parses comma separated ports and ranges like 8000-8010.
+func portList(s string) ([]int, error) {
+	var ports []int
+	for _, r := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(r, "-")
+		first, err := strconv.Atoi(from)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(to)
+		}
+		if err != nil || first <= 0 || last > 65535 || last < first {
+			return nil, fmt.Errorf("bad port or range %q", r)
+		}
+		for port := first; port <= last; port++ {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// resolveOverrides parses host:port:ip entries, an ipv6 ip may be bracketed.
+func resolveOverrides(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	overrides := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("bad resolve entry %q, want host:port:ip", entry)
+		}
+		ip := strings.TrimSuffix(strings.TrimPrefix(parts[2], "["), "]")
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("bad ip in resolve entry %q", entry)
+		}
+		overrides[strings.ToLower(net.JoinHostPort(parts[0], parts[1]))] = ip
+	}
+	return overrides, nil
+}
+
+// field looks up a numeric field of info case insensitively,
+// a trailing Ms or TimeMs may be left out: ttfb, connect, TotalSize.
+func field(info *h.Info, name string) (string, bool) {
+	name = strings.ToLower(name)
+	v := reflect.ValueOf(info).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		n := strings.ToLower(v.Type().Field(i).Name)
+		if name != n && name != strings.TrimSuffix(n, "ms") && name != strings.TrimSuffix(n, "timems") {
+			continue
+		}
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return fmt.Sprint(f.Interface()), true
+		}
+	}
+	return "", false
+}
@@ -31,17 +31,24 @@ func (ce ConversionError) Error() string {
 	return fmt.Sprintf("%s: %v", ce.Context, ce.Err)
 }
 
+// ipv6Address is an ipv6 address as ping prints it, a link-local one with its zone.
+const ipv6Address = `[0-9A-Fa-f]*:[0-9A-Fa-f:.]*(%[^\s:,]+)?`
+
 var (
-	headerRx         = regexp.MustCompile(`^PING (?P<host>.*) \((?P<resolvedIPAddress>\d+\.\d+\.\d+\.\d+)\)( from .* :)? (?P<payloadSize>\d+)\((?P<payloadActualSize>\d+)\) bytes of data`)
-	headerRxAlt      = regexp.MustCompile(`^PING (?P<host>.*) \((?P<resolvedIPAddress>\d+\.\d+\.\d+\.\d+)\)( from .*)?: (?P<payloadSize>\d+) data bytes`)
-	lineRx           = regexp.MustCompile(`^(?P<replySize>\d+) bytes from (?P<fromAddress>\d+\.\d+\.\d+\.\d+): icmp_seq=(?P<seqNo>\d+) ttl=(?P<ttl>\d+) time=(?P<time>.*)$`)
-	statsSeparatorRx = regexp.MustCompile(`^--- (?P<IPAddress>.*) ping statistics ---$`)
+	headerRx    = regexp.MustCompile(`^PING (?P<host>.*) \((?P<resolvedIPAddress>\d+\.\d+\.\d+\.\d+)\)( from .* :)? (?P<payloadSize>\d+)\((?P<payloadActualSize>\d+)\) bytes of data`)
+	headerRxAlt = regexp.MustCompile(`^PING (?P<host>.*) \((?P<resolvedIPAddress>\d+\.\d+\.\d+\.\d+)\)( from .*)?: (?P<payloadSize>\d+) data bytes`)
+	// iputils, "PING ::1(::1) 56 data bytes", newer ones put a space before "("
+	headerRx6 = regexp.MustCompile(`^PING (?P<host>\S+?) ?\((?P<resolvedIPAddress>` + ipv6Address + `)\)( from .*)?:? (?P<payloadSize>\d+) data bytes`)
+	// ping6 of darwin, "PING6(56=40+8+8 bytes) ::1 --> ::1"
+	headerRxPing6    = regexp.MustCompile(`^PING6\((?P<payloadActualSize>\d+)=\d+\+\d+\+(?P<payloadSize>\d+) bytes\) \S+ --> (?P<resolvedIPAddress>` + ipv6Address + `)$`)
+	lineRx           = regexp.MustCompile(`^(?P<replySize>\d+) bytes from (?P<fromAddress>\d+\.\d+\.\d+\.\d+|` + ipv6Address + `)[:,] icmp_seq=(?P<seqNo>\d+) (ttl|hlim)=(?P<ttl>\d+) time=(?P<time>.*)$`)
+	statsSeparatorRx = regexp.MustCompile(`^--- (?P<IPAddress>.*) ping6? statistics ---$`)
 	statsLine1       = regexp.MustCompile(`^(?P<packetsTransmitted>\d+) packets transmitted, (?P<packetsReceived>\d+) (packets )?received,( \+(?P<errors>\d+) errors,)?( \+(?P<duplicates>\d+) duplicates,)?( (?P<packetLoss>.*)% packet loss)?(, time (?P<time>.*))?( \-\- (?P<warning>.*))?$`)
-	statsLine2       = regexp.MustCompile(`^(rtt|round-trip) min/avg/max/(mdev|stddev) = (?P<min>[^/]+)/(?P<avg>[^/]+)/(?P<max>[^/]+)/(?P<mdev>[^ ]+) (?P<unit>.*)$`)
+	statsLine2       = regexp.MustCompile(`^(rtt|round-trip) min/avg/max/(mdev|stddev|std-dev) = (?P<min>[^/]+)/(?P<avg>[^/]+)/(?P<max>[^/]+)/(?P<mdev>[^ ]+) (?P<unit>.*)$`)
 	pipeNo           = regexp.MustCompile(`(?P<unit>[^,]+), pipe (?P<pipeNo>\d+)$`)
 	pipeNoLine       = regexp.MustCompile(`^pipe (?P<pipeNo>\d+)$`)
-	hostErrorLineRx1 = regexp.MustCompile(`^From (?P<fromAddress>\d+\.\d+\.\d+\.\d+) icmp_seq=(?P<seqNo>\d+) (?P<error>.*)$`)
-	hostErrorLineRx2 = regexp.MustCompile(`^(?P<replySize>\d+) bytes from (?P<fromAddress>\d+\.\d+\.\d+\.\d+): (?P<error>.*)$`)
+	hostErrorLineRx1 = regexp.MustCompile(`^From (?P<fromAddress>\d+\.\d+\.\d+\.\d+|` + ipv6Address + `) icmp_seq=(?P<seqNo>\d+) (?P<error>.*)$`)
+	hostErrorLineRx2 = regexp.MustCompile(`^(?P<replySize>\d+) bytes from (?P<fromAddress>\d+\.\d+\.\d+\.\d+|` + ipv6Address + `): (?P<error>.*)$`)
 )
 
 // PingOutput contains the whole ping operation output.
@@ -107,19 +114,25 @@ func Parse(s string) (*PingOutput, error) {
 		return nil, ErrNotEnoughLines
 	}
 	var result map[string]string
+	headers := []*regexp.Regexp{headerRx, headerRxAlt, headerRx6, headerRxPing6}
 	if runtime.GOOS == "darwin" {
-		result = matchAsMap(headerRxAlt, lines[0])
-	} else {
-		result = matchAsMap(headerRx, lines[0])
-		if len(result) == 0 {
-			result = matchAsMap(headerRxAlt, lines[0])
-			if len(result) == 0 {
-				return nil, ErrHeaderMismatch
-			}
+		headers = []*regexp.Regexp{headerRxAlt, headerRxPing6}
+	}
+	for _, rx := range headers {
+		result = matchAsMap(rx, lines[0])
+		if len(result) != 0 {
+			break
 		}
 	}
+	if len(result) == 0 {
+		return nil, ErrHeaderMismatch
+	}
 
 	po.Host = result["host"]
+	if po.Host == "" {
+		// the header of ping6 only has the address
+		po.Host = result["resolvedIPAddress"]
+	}
 	po.ResolvedIPAddress = result["resolvedIPAddress"]
 	payloadSize, err := strconv.ParseUint(result["payloadSize"], 10, 64)
 	if err != nil {
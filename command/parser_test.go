@@ -2,6 +2,7 @@ package command
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -23,3 +24,32 @@ func TestPingResult(t *testing.T) {
 	result = matchAsMap(headerRx, s)
 	assert.NotEmpty(t, result)
 }
+
+func TestParseIPv6(t *testing.T) {
+	po, err := Parse(`PING fe80::1%eth0(fe80::1%eth0) 56 data bytes
+64 bytes from fe80::1%eth0: icmp_seq=1 ttl=64 time=0.512 ms
+From fe80::1%eth0 icmp_seq=2 Destination unreachable: Address unreachable
+
+--- fe80::1%eth0 ping statistics ---
+2 packets transmitted, 1 received, +1 errors, 50% packet loss, time 1001ms
+rtt min/avg/max/mdev = 0.512/0.512/0.512/0.000 ms
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, "fe80::1%eth0", po.ResolvedIPAddress)
+	assert.Equal(t, []PingReply{
+		{Size: 64, FromAddress: "fe80::1%eth0", SequenceNumber: 1, TTL: 64, Time: 512 * time.Microsecond},
+		{FromAddress: "fe80::1%eth0", SequenceNumber: 2, Error: "Destination unreachable: Address unreachable"},
+	}, po.Replies)
+
+	for _, s := range []string{
+		"PING ::1 (::1) 56 data bytes",
+		"PING 2001:db8::1(2001:db8::1) from 2001:db8::2 eth0: 56 data bytes",
+	} {
+		result := matchAsMap(headerRx6, s)
+		assert.NotEmpty(t, result, s)
+	}
+	result := matchAsMap(headerRxPing6, "PING6(56=40+8+8 bytes) ::1 --> ::1")
+	assert.Equal(t, "::1", result["resolvedIPAddress"])
+	result = matchAsMap(lineRx, "16 bytes from ::1, icmp_seq=0 hlim=64 time=0.063 ms")
+	assert.Equal(t, "64", result["ttl"])
+}
@@ -4,6 +4,7 @@ package command
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"os/exec"
 	"runtime"
 	"strconv"
@@ -11,18 +12,23 @@ import (
 	"syscall"
 )
 
-// Ping will ping the specified IPv4 address with the provided timeout, interval and size settings .
-func Ping(ipV4Address string, interval, timeout int, count int, sourceAddr string) (*PingOutput, error) {
+// Ping will ping the specified IPv4 or IPv6 address with the provided timeout, interval and size settings .
+// A link-local IPv6 address keeps its zone, like fe80::1%eth0.
+func Ping(address string, interval, timeout int, count int, sourceAddr string) (*PingOutput, error) {
 	var (
 		output, errorOutput bytes.Buffer
 		exitCode            int
 	)
 	var pingArgs = []string{"-n", "-i", strconv.Itoa(interval), "-c", strconv.Itoa(count)}
-	if sourceAddr != "" {
-		array := strings.Split(sourceAddr, ":")
-		sourceAddr = array[0]
+	if host, _, err := net.SplitHostPort(sourceAddr); err == nil {
+		sourceAddr = host
 	}
+	name := "ping"
 	if runtime.GOOS == "darwin" {
+		if strings.Contains(address, ":") {
+			// the ping of darwin is ipv4 only
+			name = "ping6"
+		}
 		if sourceAddr != "" {
 			pingArgs = append(pingArgs, "-S", sourceAddr)
 		}
@@ -31,8 +37,8 @@ func Ping(ipV4Address string, interval, timeout int, count int, sourceAddr strin
 			pingArgs = append(pingArgs, "-I", sourceAddr)
 		}
 	}
-	pingArgs = append(pingArgs, ipV4Address)
-	cmd := exec.Command("ping", pingArgs...)
+	pingArgs = append(pingArgs, address)
+	cmd := exec.Command(name, pingArgs...)
 	cmd.Stdout = &output
 	cmd.Stderr = &errorOutput
 	err := cmd.Run()
@@ -52,7 +58,65 @@ func Ping(ipV4Address string, interval, timeout int, count int, sourceAddr strin
 	}
 
 	// in case of error, use also the execution context errors (if any)
-	return nil, fmt.Errorf("command: ping %s\nexit code: %d\nparse error: %v\nstdout:\n%s\nstderr:\n%s", strings.Join(pingArgs, " "), exitCode, err, output.String(), errorOutput.String())
+	return nil, &ExecError{
+		Args:     pingArgs,
+		ExitCode: exitCode,
+		Err:      err,
+		Stdout:   output.String(),
+		Stderr:   errorOutput.String(),
+	}
+}
+
+// ExecError is returned when ping ran but its output could not be parsed.
+type ExecError struct {
+	Args     []string
+	ExitCode int
+	Err      error
+	Stdout   string
+	Stderr   string
+}
+
+func (e *ExecError) Error() string {
+	return fmt.Sprintf("command: ping %s\nexit code: %d\nparse error: %v\nstdout:\n%s\nstderr:\n%s", strings.Join(e.Args, " "), e.ExitCode, e.Err, e.Stdout, e.Stderr)
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// the sysexits codes of the bsd ping of darwin
+const (
+	exitOSErr  = 71
+	exitNoPerm = 77
+)
+
+// PermissionDenied reports whether ping failed for lack of raw socket privileges.
+// iputils exits with 2 for any error and darwin with EX_OSERR for a failed
+// socket, those are taken for a denial when this process is refused both
+// kinds of icmp socket too.
+func (e *ExecError) PermissionDenied() bool {
+	switch e.ExitCode {
+	case exitNoPerm:
+		return true
+	case 2, exitOSErr:
+		return icmpDenied()
+	}
+	return false
+}
+
+// icmpDenied tries the raw and the unprivileged datagram icmp sockets ping opens.
+func icmpDenied() bool {
+	for _, typ := range []int{syscall.SOCK_RAW, syscall.SOCK_DGRAM} {
+		fd, err := syscall.Socket(syscall.AF_INET, typ, syscall.IPPROTO_ICMP)
+		if err == nil {
+			_ = syscall.Close(fd)
+			return false
+		}
+		if err != syscall.EPERM && err != syscall.EACCES {
+			return false
+		}
+	}
+	return true
 }
 
 func parseExitCode(err error) (int, error) {
@@ -66,5 +130,5 @@ func parseExitCode(err error) (int, error) {
 	// in this situation, exit code could not be get, and stderr will be
 	// empty string very likely, so we use the default fail code, and format err
 	// to string and set to stderr
-	return 0, fmt.Errorf("could not get exit code for failed program: %v", err)
+	return 0, fmt.Errorf("could not get exit code for failed program: %w", err)
 }
@@ -0,0 +1,93 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Capture is a running tcpdump writing to a pcap file.
+type Capture struct {
+	cmd    *exec.Cmd
+	file   string
+	stderr bytes.Buffer
+	mutex  sync.Mutex
+	done   chan error
+}
+
+// StartCapture runs tcpdump on all interfaces with the bpf filter, like
+// "tcp and host 1.2.3.4 and port 443", and returns once it is listening.
+// Capturing usually needs root or CAP_NET_RAW.
+func StartCapture(file, filter string) (*Capture, error) {
+	c := &Capture{file: file, done: make(chan error, 1)}
+	c.cmd = exec.Command("tcpdump", "-i", "any", "-n", "-U", "-w", file, filter)
+	stderr, err := c.cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = c.cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	listening := make(chan struct{})
+	go func() {
+		r := bufio.NewReader(stderr)
+		started := false
+		for {
+			line, err := r.ReadString('\n')
+			c.mutex.Lock()
+			c.stderr.WriteString(line)
+			c.mutex.Unlock()
+			if !started && strings.Contains(line, "listening on") {
+				started = true
+				close(listening)
+			}
+			if err != nil {
+				break
+			}
+		}
+		c.done <- c.cmd.Wait()
+	}()
+
+	select {
+	case <-listening:
+		return c, nil
+	case err = <-c.done:
+		return nil, fmt.Errorf("tcpdump: %v: %s", err, strings.TrimSpace(c.output()))
+	case <-time.After(2 * time.Second):
+		_ = c.cmd.Process.Kill()
+		<-c.done
+		return nil, fmt.Errorf("tcpdump did not start listening: %s", strings.TrimSpace(c.output()))
+	}
+}
+
+func (c *Capture) output() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stderr.String()
+}
+
+func (c *Capture) File() string {
+	return c.file
+}
+
+// Stop flushes the pcap file and waits for tcpdump to exit.
+func (c *Capture) Stop() error {
+	_ = c.cmd.Process.Signal(syscall.SIGINT)
+	select {
+	case err := <-c.done:
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.Exited() {
+			return fmt.Errorf("tcpdump: %v: %s", err, strings.TrimSpace(c.output()))
+		}
+		return nil
+	case <-time.After(2 * time.Second):
+		_ = c.cmd.Process.Kill()
+		return fmt.Errorf("tcpdump did not stop, killed")
+	}
+}
@@ -3,57 +3,202 @@ package http
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/qiniu/httpping/command"
 	"github.com/qiniu/httpping/network"
 )
 
 type TcpWrapper struct {
 	ip           string
+	ipHost       string // the host ip stands for, redirects elsewhere look up their own
 	verifyHost   bool
+	clientCert   *tls.Certificate
+	rootCAs      *x509.CertPool
+	certSent     bool
+	certProblem  string // why the unverified certificate would not verify
+	sessionCache tls.ClientSessionCache
+	serverName   string // overrides the SNI of the dialed host
+	sni          string
+	tlsResumed   bool
 	ping         func(addr string)
-	d            *net.TCPConn
+	observer     *Observer
+	d            net.Conn // a *net.TCPConn unless Pinger.Dialer made it otherwise
 	count        int64
+	writeCount   int64
+	firstWrite   *time.Time
 	lastWrite    time.Time
 	firstRead    *time.Time
+	lastRead     time.Time
+	maxStall     time.Duration // longest gap between reads since firstRead
+	eof          chan struct{} // closed once the server closed the connection
+	eofTime      time.Time
 	tlsHandshake time.Duration
 	connectStart time.Time
 	dnsTime      time.Duration
 	tcpHandshake time.Duration
+	congestion   string
 	remoteAddr   *net.TCPAddr
+	altAddr      *net.TCPAddr // the other family when racing
+	eyeballs     *eyeballs
 	localAddr    string
+	boundAddr    *net.TCPAddr // localAddr resolved
 	domain       string
 	error        string
 	rounds       []RoundTime
+	nextRequest  bool
+
+	// the transport keeps reading a kept alive connection after the body,
+	// once measured only the close is recorded and the counters stay put
+	readMutex sync.Mutex
+	measured  bool
+
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	denyReserved   bool
+	doh            string
+	tos            int
+	overrides      map[string]string
+	resolver       func(ctx context.Context, host string) ([]net.IP, error)
+	dialer         func(ctx context.Context, d *net.Dialer, address string) (net.Conn, error)
+	debug          *Debug
+	portFrom       int
+	portTo         int
+
+	maxConnDuration  time.Duration
+	lifetime         *time.Timer
+	lifetimeExceeded atomic.Bool
+
+	pcapFile  string
+	capture   *command.Capture
+	pcapError string
+}
+
+// ErrReservedAddress is the cause when DenyReserved refuses to dial.
+var ErrReservedAddress = errors.New("reserved address denied")
+
+// timeoutError names the phase that ran out of time, it stays a
+// net.Error so the http client treats it as the timeout it is.
+type timeoutError struct {
+	phase   string
+	timeout time.Duration
+	err     error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timeout after %v: %v", e.phase, e.timeout, e.err)
+}
+
+func (e *timeoutError) Unwrap() error   { return e.err }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
 }
 
 func (t *TcpWrapper) Read(b []byte) (n int, err error) {
 	n, err = t.d.Read(b)
+	if err != nil && t.readTimeout > 0 && isTimeout(err) {
+		err = &timeoutError{phase: "read", timeout: t.readTimeout, err: err}
+	} else if err != nil && t.lifetimeExceeded.Load() {
+		err = fmt.Errorf("connection lifetime %v exceeded: %w", t.maxConnDuration, err)
+	}
+	now := time.Now()
+	t.readMutex.Lock()
+	defer t.readMutex.Unlock()
+	if err == io.EOF && t.eof != nil {
+		select {
+		case <-t.eof:
+		default:
+			t.eofTime = now
+			close(t.eof)
+		}
+	}
+	if t.measured {
+		return
+	}
+	t.debug.add("read", n, err)
 	t.count += int64(n)
 	if t.firstRead == nil {
-		tm := time.Now()
-		t.firstRead = &tm
+		t.firstRead = &now
+		t.lastRead = now
+		t.maxStall = 0
+	} else if n > 0 {
+		if gap := now.Sub(t.lastRead); gap > t.maxStall {
+			t.maxStall = gap
+		}
+		t.lastRead = now
 	}
 	return
 }
 
 func (t *TcpWrapper) Write(b []byte) (n int, err error) {
+	if t.nextRequest {
+		t.nextRequest = false
+		t.firstRead = nil
+		t.firstWrite = nil
+	}
+	if t.readTimeout > 0 {
+		// the response is due from the last write of the request
+		_ = t.d.SetReadDeadline(time.Now().Add(t.readTimeout))
+	}
 	n, err = t.d.Write(b)
+	t.debug.add("write", n, err)
+	t.writeCount += int64(n)
 	t.lastWrite = time.Now()
+	if t.firstWrite == nil {
+		tm := t.lastWrite
+		t.firstWrite = &tm
+	}
 	return
 }
 
 func (t *TcpWrapper) Close() error {
+	if t.lifetime != nil {
+		t.lifetime.Stop()
+	}
+	t.stopCapture()
 	if t.d != nil {
 		return t.d.Close()
 	}
 	return nil
 }
 
+// stopCounting freezes the read accounting once the response is measured,
+// the reads of the transport after that only record the close.
+func (t *TcpWrapper) stopCounting() {
+	t.readMutex.Lock()
+	t.measured = true
+	t.readMutex.Unlock()
+	if t.readTimeout > 0 && t.d != nil {
+		// the response is in, an idle kept alive connection has no deadline
+		_ = t.d.SetReadDeadline(time.Time{})
+	}
+}
+
+// resetCounters starts the accounting over for the next request on the same connection.
+func (t *TcpWrapper) resetCounters() {
+	t.readMutex.Lock()
+	defer t.readMutex.Unlock()
+	t.measured = false
+	t.count = 0
+	t.writeCount = 0
+	t.firstRead = nil
+	t.firstWrite = nil
+	t.rounds = nil
+}
+
 func (t *TcpWrapper) TcpHandshake() time.Duration {
 	return t.tcpHandshake
 }
@@ -86,22 +231,71 @@ func (t *TcpWrapper) SetWriteDeadline(tm time.Time) error {
 	return t.d.SetWriteDeadline(tm)
 }
 
-func (t *TcpWrapper) resolve(addrStr string) error {
+func (t *TcpWrapper) resolve(ctx context.Context, addrStr string) error {
 	host, port, err := net.SplitHostPort(addrStr)
-	if t.d == nil && t.ip != "" {
+	overrideIp, overridden := t.overrides[strings.ToLower(addrStr)]
+	if overridden && err == nil {
+		addrStr = net.JoinHostPort(overrideIp, port)
+	} else if t.ip != "" && (t.ipHost == "" || strings.EqualFold(host, t.ipHost)) {
 		if err != nil {
 			return err
 		}
 		addrStr = net.JoinHostPort(t.ip, port)
 	}
 	dnsStart := time.Now()
+	t.altAddr = nil
+	// a literal address, also a forced ip, has nothing to race or look up
+	if lookupHost, _, _ := net.SplitHostPort(addrStr); (t.eyeballs != nil || t.doh != "" || t.resolver != nil) && net.ParseIP(lookupHost) == nil {
+		return t.resolveFamilies(ctx, host, port, dnsStart)
+	}
 	addr, err := net.ResolveTCPAddr("tcp", addrStr)
 	if err != nil {
 		return err
 	}
 	t.dnsTime = time.Since(dnsStart)
+	if overridden {
+		t.dnsTime = 0
+	}
 	t.remoteAddr = addr
 	t.domain = host
+	t.observer.dnsDone(addr.IP.String(), t.dnsTime)
+	return nil
+}
+
+// resolveFamilies looks up both families of host, through DoH or the
+// Pinger.Resolver when set, the second family is only kept for a Happy
+// Eyeballs race.
+func (t *TcpWrapper) resolveFamilies(ctx context.Context, host, port string, dnsStart time.Time) error {
+	portNum, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return err
+	}
+	var ips []net.IP
+	if t.doh != "" {
+		ips, err = dohLookup(t.doh, host)
+	} else if t.resolver != nil {
+		ips, err = t.resolver(ctx, host)
+	} else {
+		ips, err = net.LookupIP(host)
+	}
+	if err != nil {
+		return err
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("no address for %s", host)
+	}
+	t.dnsTime = time.Since(dnsStart)
+	primary, fallback := splitFamilies(ips)
+	if t.eyeballs == nil && fallback != nil {
+		// prefer ipv4 like the system resolver path does
+		primary, fallback = fallback, nil
+	}
+	t.remoteAddr = &net.TCPAddr{IP: primary, Port: portNum}
+	if fallback != nil {
+		t.altAddr = &net.TCPAddr{IP: fallback, Port: portNum}
+	}
+	t.domain = host
+	t.observer.dnsDone(primary.String(), t.dnsTime)
 	return nil
 }
 
@@ -114,8 +308,12 @@ func newPort() int {
 	return int(base + x)
 }
 
-func (t *TcpWrapper) recordPrev() {
+// recordHop saves the timing of a redirect response and starts the next hop,
+// which may reuse the connection and then pays no dns or handshakes.
+func (t *TcpWrapper) recordHop(url string, code int) {
 	r := RoundTime{
+		Url:                url,
+		Code:               code,
 		Domain:             t.domain,
 		Ip:                 t.remoteAddr.IP.String(),
 		Port:               t.remoteAddr.Port,
@@ -127,68 +325,240 @@ func (t *TcpWrapper) recordPrev() {
 		TotalTimeMs:        time.Now().Sub(t.connectStart).Milliseconds(),
 	}
 	t.rounds = append(t.rounds, r)
+	t.dnsTime = 0
+	t.tcpHandshake = 0
+	t.tlsHandshake = 0
+	t.connectStart = time.Now()
+	// the client still drains the redirect body, so only forget the
+	// first read once the next request is written
+	t.nextRequest = true
 }
 
-func (t *TcpWrapper) connect() (err error) {
-	var localAddr *net.TCPAddr
-	var randAddr = false
+// resolveLocalAddr accepts an ip, ip:port or an interface name like eth1,
+// an interface is bound to its primary address.
+func resolveLocalAddr(addr string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "0"
+	}
+	if net.ParseIP(host) == nil {
+		ip, err := interfaceAddr(host)
+		if err != nil {
+			return nil, fmt.Errorf("source address %s: %w", host, err)
+		}
+		host = ip.String()
+	}
+	return net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+}
+
+func interfaceAddr(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var v6 net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if v6 == nil {
+			v6 = ipNet.IP
+		}
+	}
+	if v6 != nil {
+		return v6, nil
+	}
+	return nil, fmt.Errorf("no usable address on interface %s", name)
+}
+
+func (t *TcpWrapper) connect(ctx context.Context) (err error) {
+	// an interface name is looked up too, keep it out of the connect time
+	t.boundAddr = nil
 	if t.localAddr != "" {
-		if !strings.Contains(t.localAddr, ":") {
-			localAddr, err = net.ResolveTCPAddr("tcp", t.localAddr+":0")
-			if err != nil {
-				return err
-			}
-		} else {
-			localAddr, err = net.ResolveTCPAddr("tcp", t.localAddr)
-			if err != nil {
-				return err
-			}
+		t.boundAddr, err = resolveLocalAddr(t.localAddr)
+		if err != nil {
+			return err
 		}
+	}
+	t.connectStart = time.Now()
+	var conn net.Conn
+	if t.altAddr != nil {
+		conn, err = t.race(ctx)
 	} else {
+		if t.eyeballs != nil {
+			// a single family, no race to report
+			t.eyeballs = &eyeballs{}
+		}
+		conn, err = t.dialOnce(ctx, t.remoteAddr)
+	}
+	if err != nil {
+		return err
+	}
+	t.tcpHandshake = time.Since(t.connectStart)
+	t.observer.connected(t.tcpHandshake)
+	t.d = conn
+	t.readMutex.Lock()
+	t.eof = make(chan struct{})
+	t.readMutex.Unlock()
+	tcpConn, _ := conn.(*net.TCPConn)
+	// read now, a server closing after the body leaves no socket to ask later
+	t.congestion, _ = network.GetCongestionControl(tcpConn)
+	t.limitLifetime(conn)
+	return nil
+}
+
+// limitLifetime closes conn once it is maxConnDuration old, busy or not.
+func (t *TcpWrapper) limitLifetime(conn net.Conn) {
+	if t.lifetime != nil {
+		t.lifetime.Stop()
+	}
+	t.lifetimeExceeded.Store(false)
+	if t.maxConnDuration <= 0 {
+		return
+	}
+	t.lifetime = time.AfterFunc(t.maxConnDuration, func() {
+		t.lifetimeExceeded.Store(true)
+		_ = conn.Close()
+	})
+}
+
+func (t *TcpWrapper) dialTimeout() time.Duration {
+	if t.connectTimeout > 0 {
+		return t.connectTimeout
+	}
+	return time.Second
+}
+
+func (t *TcpWrapper) dialOnce(ctx context.Context, remoteAddr *net.TCPAddr) (conn net.Conn, err error) {
+	var rangeAddr *net.TCPAddr
+	var randAddr = false
+	localAddr := t.boundAddr
+	if localAddr == nil && t.portFrom == 0 {
 		randAddr = true
 	}
+	port := t.portFrom
+	if port != 0 {
+		rangeAddr = &net.TCPAddr{}
+		if localAddr != nil {
+			rangeAddr.IP = localAddr.IP
+			rangeAddr.Zone = localAddr.Zone
+		}
+	}
 
 dial:
 	if randAddr {
 		localAddr, err = net.ResolveTCPAddr("tcp", ":"+strconv.Itoa(newPort()))
 		if err != nil {
-			return err
+			return nil, err
 		}
+	} else if rangeAddr != nil {
+		localAddr = &net.TCPAddr{IP: rangeAddr.IP, Port: port, Zone: rangeAddr.Zone}
 	}
 
+	timeout := t.dialTimeout()
 	dialer := net.Dialer{
-		Timeout:   time.Second,
+		Timeout:   timeout,
 		LocalAddr: localAddr,
 	}
+	if t.tos != 0 {
+		dialer.Control = network.TOSControl(t.tos)
+	}
 
-	t.connectStart = time.Now()
-	conn, err := dialer.Dial("tcp", t.remoteAddr.String())
+	if t.dialer != nil {
+		conn, err = t.dialer(ctx, &dialer, remoteAddr.String())
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", remoteAddr.String())
+	}
 	if err != nil {
 		if randAddr && network.IsEADDRINUSE(err) {
 			goto dial
 		}
-		return err
+		if rangeAddr != nil && network.IsEADDRINUSE(err) {
+			if port < t.portTo {
+				port++
+				goto dial
+			}
+			return nil, fmt.Errorf("no free local port in %d-%d: %w", t.portFrom, t.portTo, err)
+		}
+		if isTimeout(err) && ctx.Err() == nil {
+			err = &timeoutError{phase: "connect", timeout: timeout, err: err}
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t *TcpWrapper) checkReserved() error {
+	if !t.denyReserved {
+		return nil
+	}
+	if network.IsReserved(t.remoteAddr.IP) {
+		return fmt.Errorf("%s resolves to %s: %w", t.domain, t.remoteAddr.IP, ErrReservedAddress)
+	}
+	if t.altAddr != nil && network.IsReserved(t.altAddr.IP) {
+		t.altAddr = nil
 	}
-	t.tcpHandshake = time.Since(t.connectStart)
-	tcpConn, _ := conn.(*net.TCPConn)
-	t.d = tcpConn
 	return nil
 }
 
-func (t *TcpWrapper) Dial(_ context.Context, network, addr string) (conn net.Conn, err error) {
+// startCapture captures the first connection to pcapFile, a failure to
+// capture is kept in pcapError and does not stop the measurement.
+func (t *TcpWrapper) startCapture() {
+	if t.pcapFile == "" || t.capture != nil || t.pcapError != "" {
+		return
+	}
+	filter := fmt.Sprintf("tcp and host %s and port %d", t.remoteAddr.IP, t.remoteAddr.Port)
+	capture, err := command.StartCapture(t.pcapFile, filter)
+	if err != nil {
+		t.pcapError = err.Error()
+		return
+	}
+	t.capture = capture
+}
+
+func (t *TcpWrapper) stopCapture() {
+	if t.capture == nil {
+		return
+	}
+	err := t.capture.Stop()
+	if err != nil {
+		t.pcapError = err.Error()
+	}
+	t.capture = nil
+}
+
+func (t *TcpWrapper) Dial(ctx context.Context, network, addr string) (conn net.Conn, err error) {
 	if t.d != nil {
-		t.recordPrev()
 		_ = t.d.Close()
 	}
-	err = t.resolve(addr)
+	err = t.resolve(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
+	err = t.checkReserved()
+	if err != nil {
+		return nil, err
+	}
+	t.startCapture()
 	if t.d == nil && t.ping != nil {
-		go t.ping(t.remoteAddr.IP.String())
+		pingAddr := t.remoteAddr.IP.String()
+		if t.remoteAddr.Zone != "" {
+			// link-local addresses are useless without their interface
+			pingAddr += "%" + t.remoteAddr.Zone
+		}
+		go t.ping(pingAddr)
 	}
 	t.firstRead = nil
-	err = t.connect()
+	t.firstWrite = nil
+	err = t.connect(ctx)
 	return t, err
 }
 
@@ -197,23 +567,79 @@ func (t *TcpWrapper) DialTLS(ctx context.Context, network, addr string) (conn ne
 	if err != nil {
 		return nil, err
 	}
-	cfg := tls.Config{ServerName: strings.Split(addr, ":")[0], InsecureSkipVerify: !t.verifyHost}
-	cl := tls.Client(td, &cfg)
+	serverName := strings.Split(addr, ":")[0]
+	if t.serverName != "" {
+		serverName = t.serverName
+	}
+	t.sni = serverName
+	cl := tls.Client(td, t.tlsConfig(serverName))
 	start := time.Now()
 	err = cl.HandshakeContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 	t.tlsHandshake = time.Since(start)
+	state := cl.ConnectionState()
+	t.certProblem = t.verifyPeer(state, serverName)
+	t.tlsResumed = state.DidResume
+	t.observer.tlsDone(t.tlsHandshake)
 	t.firstRead = nil //reset for https
+	t.firstWrite = nil
+	t.writeCount = 0 // the request only, not the handshake
 	return cl, nil
 }
 
+func (t *TcpWrapper) tlsConfig(serverName string) *tls.Config {
+	cfg := tls.Config{ServerName: serverName, InsecureSkipVerify: !t.verifyHost, RootCAs: t.rootCAs, ClientSessionCache: t.sessionCache}
+	if t.clientCert != nil {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			t.certSent = true
+			return t.clientCert, nil
+		}
+	}
+	return &cfg
+}
+
+// waitEOF waits up to timeout for the server to close the connection,
+// it is how many ms that took after the last byte, -1 when it did not.
+func (t *TcpWrapper) waitEOF(timeout time.Duration) int64 {
+	if t.eof == nil {
+		return -1
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.eof:
+		t.readMutex.Lock()
+		defer t.readMutex.Unlock()
+		return t.eofTime.Sub(t.lastRead).Milliseconds()
+	case <-timer.C:
+		return -1
+	}
+}
+
 func (t *TcpWrapper) TTFB() time.Duration {
+	if t.firstRead == nil {
+		return 0
+	}
 	return t.firstRead.Sub(t.lastWrite)
 }
 
+// tcpConn is nil for a connection that is not tcp, like a fake of a test.
+func (t *TcpWrapper) tcpConn() *net.TCPConn {
+	c, _ := t.d.(*net.TCPConn)
+	return c
+}
+
 func (t *TcpWrapper) CommonInfo() (*network.TCPInfo, error) {
-	i, _, err := network.GetSockoptTCPInfo(t.d)
+	i, _, err := network.GetSockoptTCPInfo(t.tcpConn())
 	return i, err
 }
+
+func (t *TcpWrapper) tcpInfo() (*network.TCPInfo, *network.TCPExtInfo, error) {
+	i, raw, err := network.GetSockoptTCPInfo(t.tcpConn())
+	if err != nil {
+		return nil, nil, err
+	}
+	return i, network.ExtInfo(raw), nil
+}
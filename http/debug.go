@@ -0,0 +1,94 @@
+package http
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Debug is the raw event log of the TcpWrapper behind an Info, to tell a
+// measurement bug from real network behavior when a number looks wrong.
+// Times are in µs from ConnectStart.
+type Debug struct {
+	ConnectStart time.Time
+	FirstWriteUs int64 // -1 when nothing was written
+	LastWriteUs  int64
+	FirstReadUs  int64 // -1 when nothing was read
+	LastReadUs   int64
+	Events       []IOEvent
+
+	mutex sync.Mutex
+}
+
+// IOEvent is one Read or Write call on the connection.
+type IOEvent struct {
+	Op    string // read or write
+	AtUs  int64  // when the call returned
+	Size  int
+	Error string `json:",omitempty"`
+}
+
+func (d *Debug) String() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	t, _ := json.MarshalIndent(d, "", "	")
+	return string(t)
+}
+
+// add may be called from the read and the write side of the transport at once.
+func (d *Debug) add(op string, n int, err error) {
+	if d == nil {
+		return
+	}
+	e := IOEvent{Op: op, AtUs: time.Now().UnixMicro(), Size: n}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	d.mutex.Lock()
+	d.Events = append(d.Events, e)
+	d.mutex.Unlock()
+}
+
+// reset empties d for the next ping, the mutex is left alone
+// as the log may be read while it is reset.
+func (d *Debug) reset() {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.ConnectStart = time.Time{}
+	d.FirstWriteUs, d.LastWriteUs = 0, 0
+	d.FirstReadUs, d.LastReadUs = 0, 0
+	d.Events = nil
+}
+
+// finish takes the timestamps of w and makes every time relative to the
+// connect. w logs no more events after, the transport may still read it.
+func (d *Debug) finish(w *TcpWrapper) {
+	if d == nil {
+		return
+	}
+	w.readMutex.Lock()
+	w.debug = nil
+	w.readMutex.Unlock()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.ConnectStart = w.connectStart
+	since := func(t time.Time) int64 {
+		return t.Sub(w.connectStart).Microseconds()
+	}
+	d.FirstWriteUs, d.FirstReadUs = -1, -1
+	if w.firstWrite != nil {
+		d.FirstWriteUs = since(*w.firstWrite)
+		d.LastWriteUs = since(w.lastWrite)
+	}
+	if w.firstRead != nil {
+		d.FirstReadUs = since(*w.firstRead)
+		d.LastReadUs = since(w.lastRead)
+	}
+	start := w.connectStart.UnixMicro()
+	for i := range d.Events {
+		d.Events[i].AtUs -= start
+	}
+}
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+var dohClient = &http.Client{Timeout: 5 * time.Second}
+
+type dohResponse struct {
+	Status int
+	Answer []struct {
+		Type int    `json:"type"`
+		Data string `json:"data"`
+	}
+}
+
+// dohLookup resolves the A and AAAA records of host concurrently through
+// the JSON api of a DNS-over-HTTPS endpoint, like
+// https://cloudflare-dns.com/dns-query or https://dns.google/resolve.
+func dohLookup(endpoint, host string) ([]net.IP, error) {
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []int{dnsTypeA, dnsTypeAAAA} {
+		go func(qtype int) {
+			ips, err := dohQuery(endpoint, host, qtype)
+			results <- result{ips, err}
+		}(qtype)
+	}
+	var ips []net.IP
+	var err error
+	for i := 0; i < 2; i++ {
+		r := <-results
+		ips = append(ips, r.ips...)
+		if r.err != nil {
+			err = r.err
+		}
+	}
+	if len(ips) != 0 {
+		return ips, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("doh lookup %s: no such host", host)
+	}
+	return nil, err
+}
+
+func dohQuery(endpoint, host string, qtype int) ([]net.IP, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("name", host)
+	q.Set("type", fmt.Sprint(qtype))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh lookup %s: http status %d", host, resp.StatusCode)
+	}
+	var r dohResponse
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, fmt.Errorf("doh lookup %s: %v", host, err)
+	}
+	if r.Status != 0 {
+		return nil, fmt.Errorf("doh lookup %s: rcode %d", host, r.Status)
+	}
+	var ips []net.IP
+	for _, a := range r.Answer {
+		// CNAMEs are listed along with the addresses they lead to
+		if a.Type != qtype {
+			continue
+		}
+		if ip := net.ParseIP(a.Data); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
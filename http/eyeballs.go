@@ -0,0 +1,141 @@
+package http
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// connectionAttemptDelay is how long the preferred family gets
+// before the other one is tried, RFC 8305 section 5.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// eyeballs is the outcome of a Happy Eyeballs race, the losing attempt
+// may still be finishing in the background. The times are those of each
+// connect on its own, the head start of the preferred family left out.
+type eyeballs struct {
+	mutex      sync.Mutex
+	winnerTime time.Duration
+	loserTime  time.Duration
+	loserDone  bool
+	settled    chan struct{} // closed once the loser connected or failed, nil without a race
+}
+
+// leadMs waits up to timeout for the loser and is how much faster the
+// winner connected, negative when the loser was faster but started late.
+// It is false when there was no race or the loser did not connect.
+func (e *eyeballs) leadMs(timeout time.Duration) (int64, bool) {
+	if e.settled == nil {
+		return 0, false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-e.settled:
+	case <-timer.C:
+		return 0, false
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !e.loserDone {
+		return 0, false
+	}
+	return (e.loserTime - e.winnerTime).Milliseconds(), true
+}
+
+func family(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// splitFamilies picks the first ipv6 and the first ipv4 address,
+// the preferred one is ipv6 when the host has both.
+func splitFamilies(ips []net.IP) (primary, fallback net.IP) {
+	var v4, v6 net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip
+			}
+		} else if v6 == nil {
+			v6 = ip
+		}
+	}
+	if v6 == nil {
+		return v4, nil
+	}
+	return v6, v4
+}
+
+type attempt struct {
+	conn net.Conn
+	addr *net.TCPAddr
+	time time.Duration
+	err  error
+}
+
+// race dials remoteAddr and altAddr in the Happy Eyeballs way and keeps
+// whichever connects first, the other connection is closed once it is up.
+func (t *TcpWrapper) race(ctx context.Context) (net.Conn, error) {
+	e := &eyeballs{settled: make(chan struct{})}
+	t.eyeballs = e
+	results := make(chan attempt, 2)
+	primaryFailed := make(chan struct{})
+	dial := func(addr *net.TCPAddr) attempt {
+		start := time.Now()
+		conn, err := t.dialOnce(ctx, addr)
+		return attempt{conn: conn, addr: addr, time: time.Since(start), err: err}
+	}
+	go func() {
+		a := dial(t.remoteAddr)
+		if a.err != nil {
+			close(primaryFailed)
+		}
+		results <- a
+	}()
+	go func() {
+		timer := time.NewTimer(connectionAttemptDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-primaryFailed:
+		case <-ctx.Done():
+		}
+		results <- dial(t.altAddr)
+	}()
+
+	first := <-results
+	if first.err != nil {
+		close(e.settled)
+		second := <-results
+		if second.err != nil {
+			return nil, first.err
+		}
+		t.won(second)
+		return second.conn, nil
+	}
+	t.won(first)
+	go func() {
+		defer close(e.settled)
+		loser := <-results
+		if loser.err != nil {
+			return
+		}
+		_ = loser.conn.Close()
+		e.mutex.Lock()
+		e.loserTime = loser.time
+		e.loserDone = true
+		e.mutex.Unlock()
+	}()
+	return first.conn, nil
+}
+
+func (t *TcpWrapper) won(a attempt) {
+	t.eyeballs.mutex.Lock()
+	t.eyeballs.winnerTime = a.time
+	t.eyeballs.mutex.Unlock()
+	t.remoteAddr = a.addr
+}
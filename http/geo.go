@@ -0,0 +1,25 @@
+package http
+
+import "net"
+
+// GeoInfo is what a GeoLookup knows about an ip, fields it cannot
+// tell are left zero.
+type GeoInfo struct {
+	ASN     uint32
+	ASOrg   string
+	Country string // ISO 3166 code, like CN
+}
+
+// recordGeo annotates the ip connected to with Pinger.GeoLookup,
+// the package ships no database of its own.
+func (p *Pinger) recordGeo(httpInfo *Info) {
+	if p.GeoLookup == nil || httpInfo.Ip == "" {
+		return
+	}
+	geo, err := p.GeoLookup(net.ParseIP(httpInfo.Ip))
+	if err != nil {
+		httpInfo.GeoError = err.Error()
+		return
+	}
+	httpInfo.Geo = &geo
+}
@@ -0,0 +1,109 @@
+package http
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Handshake connects to addr without sending any http request, with withTLS
+// the tls handshake is completed too. It suits port checks and tls services
+// that do not speak http, SysPing and the request of the Pinger are unused.
+func (p *Pinger) Handshake(addr string, withTLS bool) (*Info, error) {
+	httpInfo := Info{StartTime: time.Now()}
+	ctx := context.Background()
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	w := p.newWrapper()
+	defer w.Close()
+	var err error
+	if withTLS {
+		_, err = w.DialTLS(ctx, "tcp", addr)
+	} else {
+		_, err = w.Dial(ctx, "tcp", addr)
+	}
+	recordRemote(&httpInfo, w)
+	p.recordGeo(&httpInfo)
+	if err != nil {
+		recordCapture(&httpInfo, w)
+		httpInfo.Error = err.Error()
+		return &httpInfo, nil
+	}
+	recordConn(&httpInfo, w)
+
+	if w.tcpConn() != nil {
+		tcpInfo, err := w.CommonInfo()
+		if err != nil {
+			httpInfo.Error = err.Error()
+		} else {
+			httpInfo.Client = *tcpInfo
+		}
+	}
+	httpInfo.TotalTimeMs = (w.tcpHandshake + w.tlsHandshake).Milliseconds()
+	recordLead(&httpInfo, w)
+	recordCapture(&httpInfo, w)
+	return &httpInfo, nil
+}
+
+// PingHandshake is Handshake against the host of the request url,
+// with tls for https.
+func (p *Pinger) PingHandshake() (*Info, error) {
+	err := p.normalizeURL()
+	if err != nil {
+		return nil, err
+	}
+	return p.Handshake(canonicalAddr(p.Req), p.Req.URL.Scheme == "https")
+}
+
+// PortTime is the connect to one port of a sweep.
+type PortTime struct {
+	Port          int
+	Open          bool
+	ConnectTimeMs uint32
+	Error         string
+}
+
+// sweepConcurrency bounds the connects of a sweep in flight at once.
+const sweepConcurrency = 8
+
+// SweepPorts connects to each port of host without sending anything, to
+// see which ones listen and how fast they accept before measuring them.
+// The times are in the order of ports, PcapFile is not used.
+func (p *Pinger) SweepPorts(host string, ports []int) []PortTime {
+	sweep := *p
+	sweep.PcapFile = ""
+	times := make([]PortTime, len(ports))
+	sem := make(chan struct{}, sweepConcurrency)
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i, port int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			pt := PortTime{Port: port}
+			info, _ := sweep.Handshake(net.JoinHostPort(host, strconv.Itoa(port)), false)
+			pt.Error = info.Error
+			pt.Open = info.Error == ""
+			pt.ConnectTimeMs = info.ConnectTimeMs
+			times[i] = pt
+		}(i, port)
+	}
+	wg.Wait()
+	return times
+}
+
+// PingPorts is SweepPorts against the host of the request url.
+func (p *Pinger) PingPorts(ports []int) ([]PortTime, error) {
+	err := p.normalizeURL()
+	if err != nil {
+		return nil, err
+	}
+	return p.SweepPorts(p.Req.URL.Hostname(), ports), nil
+}
@@ -1,12 +1,28 @@
 package http
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"hash"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -21,12 +37,166 @@ type Pinger struct {
 	ServerSupport bool
 	BodyHasher    hash.Hash
 	Redirect      bool
+	MaxRedirects  int // redirects followed when Redirect is set, 10 when zero
 	Timeout       time.Duration
-	ServerIp      string
-	VerifyHost    bool
+	// ServerIp is dialed instead of looking up the host of Req, also on a
+	// redial, redirects to other hosts look them up.
+	ServerIp   string
+	VerifyHost bool
+	// DenyRedirect makes any 3xx an error, for endpoints that must never
+	// redirect, the redirect is not followed even with Redirect and its
+	// Location is kept in RedirectLocation.
+	DenyRedirect bool
+	// ReadBufferSize is the body read buffer, DefaultReadBufferSize when zero.
+	// A larger buffer means fewer read calls on fast links.
+	ReadBufferSize int
+	Observer       *Observer
+	// AcceptEncoding is sent as is, "identity" asks for an uncompressed body.
+	// When set the transport no longer decompresses gzip on its own.
+	AcceptEncoding string
+	// Http10 sends the request as HTTP/1.0, the body usually ends at connection close.
+	Http10 bool
+	// PingDone makes Ping return as soon as the http part is done instead of
+	// waiting for the system ping, which PingDone gets once done. The Info
+	// is the one returned and is left as is, PingResult.Apply fills it in.
+	PingDone func(info *Info, ping PingResult)
+	// ClientCert is presented when the server asks for one, RootCAs
+	// replaces the system pool when VerifyHost is set.
+	ClientCert *tls.Certificate
+	RootCAs    *x509.CertPool
+	// HappyEyeballs races the ipv6 and ipv4 addresses of the host and
+	// uses whichever connects first, as dual stack clients do.
+	HappyEyeballs bool
+	// ConnectTimeout bounds each tcp connect, 1s when zero. ReadTimeout
+	// bounds the response from the moment the request is written, the
+	// body download included, no limit when zero.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	// DenyReserved refuses to connect to private, loopback, link-local and
+	// other reserved addresses, for user supplied urls. It is checked on
+	// every dial, so redirects and a forced ServerIp cannot get around it.
+	DenyReserved bool
+	// DohUrl resolves the host over DNS-over-HTTPS with the JSON api of this
+	// endpoint instead of the system resolver, DnsTimeMs is the DoH lookup.
+	DohUrl string
+	// EnvProxy sends the request through the proxy of HTTP_PROXY, HTTPS_PROXY
+	// and NO_PROXY. The connection timed is then the one to the proxy, Ip
+	// and the system ping are the proxy's and ServerIp is ignored.
+	EnvProxy bool
+	// Tos is set as the IP TOS byte, the ipv6 traffic class, of the
+	// connection, DSCP << 2. Zero leaves the system default.
+	Tos int
+	// MaxConnDuration closes the connection once it is this old, even in
+	// the middle of the body, LifetimeExceeded then tells so.
+	MaxConnDuration time.Duration
+	// PcapFile captures the packets of the connection with tcpdump into
+	// this file, which needs tcpdump and the privileges to capture.
+	// When capturing fails the ping goes on and PcapError tells why.
+	// Modes making several connections write one file each, see pcapPart.
+	PcapFile string
+	// ExpectedHash is compared with the hex hash of the body, by
+	// BodyHasher or by sha256 when BodyHasher is nil.
+	ExpectedHash string
+	// ResolveOverrides maps host:port, host in lower case, to the ip to
+	// connect to, like curl's --resolve. DNS is not asked and DnsTimeMs is
+	// zero for those hosts, unlike ServerIp it also applies to redirects.
+	// Host and SNI stay the host.
+	ResolveOverrides map[string]string
+	// TLSSessionCache lets a later ping resume the tls session of an
+	// earlier one sharing the cache, TLSResumed tells whether it did.
+	TLSSessionCache tls.ClientSessionCache
+	// Progress is called while the body downloads with the body bytes so far
+	// and the time since the ping started, each ProgressBytes or each
+	// ProgressInterval, whichever comes first, and once at the end.
+	// With neither set it is called every DefaultProgressInterval.
+	Progress         func(body int64, elapsed time.Duration)
+	ProgressBytes    int64
+	ProgressInterval time.Duration
+	// PingCount is the number of echoes of the system ping, a second
+	// apart, 1 when zero. Each one is reported in PingRTTs.
+	PingCount int
+	// Debug, when set, is filled with the raw socket events of each Ping.
+	// It holds one ping at a time, the parts of PingParallel and pingers
+	// of a PingBatch sharing one are not logged.
+	Debug *Debug
+	// SuccessCodes are the expected final status codes, 2xx when empty.
+	// Such a response ends the measurement, a redirect in the list is not
+	// followed even with Redirect, any other code sets UnexpectedCode.
+	SuccessCodes []int
+	// GeoLookup is asked about the ip connected to, from a MaxMind database
+	// or any other source, the answer is kept in Info.Geo.
+	GeoLookup func(ip net.IP) (GeoInfo, error)
+	// ServerName is sent as the tls SNI, and the certificate verified
+	// against it, instead of the host of the url, Host stays the same.
+	ServerName string
+	// Resolver, Dialer and PingFunc replace the system resolver, the tcp
+	// dial and the system ping when set, so tests can run without network.
+	// Dialer gets the net.Dialer Ping would use, with its timeout, local
+	// address and control, a conn it makes that is no *net.TCPConn has no
+	// tcp info. ResolveOverrides, ServerIp and DohUrl still take precedence
+	// over Resolver.
+	Resolver func(ctx context.Context, host string) ([]net.IP, error)
+	Dialer   func(ctx context.Context, d *net.Dialer, address string) (net.Conn, error)
+	PingFunc func(addr, srcAddr string, count int) (*command.PingOutput, error)
+	// WaitClose waits this long after the body for the server to close the
+	// connection, CloseWaitMs then tells the transport level completion
+	// apart from the application level one. Zero does not wait.
+	WaitClose time.Duration
+	// RetryCodes are the status codes, like 502, 503 and 504 of an origin
+	// being deployed, on which the whole request is made again, up to
+	// Retries times, RetryBackoff apart and doubling, DefaultRetryBackoff
+	// when zero. The Info is the last attempt's, PingDone is called for
+	// each attempt.
+	RetryCodes   []int
+	Retries      int
+	RetryBackoff time.Duration
+	// LocalPortFrom and LocalPortTo bind the connection to the first free
+	// local port of the range, for egress filters that only let some
+	// source ports through, the port of SrcAddr is then ignored.
+	// LocalPortTo is LocalPortFrom when lower, LocalPort tells the one used.
+	LocalPortFrom int
+	LocalPortTo   int
 }
 
+const DefaultReadBufferSize = 64 * 1024
+
+func (p *Pinger) maxRedirects() int {
+	if p.MaxRedirects > 0 {
+		return p.MaxRedirects
+	}
+	return 10
+}
+
+func (p *Pinger) success(code int) bool {
+	if len(p.SuccessCodes) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, c := range p.SuccessCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pinger) pingCount() int {
+	if p.PingCount > 0 {
+		return p.PingCount
+	}
+	return 1
+}
+
+func (p *Pinger) readBufferSize() int {
+	if p.ReadBufferSize > 0 {
+		return p.ReadBufferSize
+	}
+	return DefaultReadBufferSize
+}
+
+// RoundTime is the timing of one redirect hop.
 type RoundTime struct {
+	Url                string
+	Code               int
 	Domain             string
 	Ip                 string
 	Port               int
@@ -38,27 +208,90 @@ type RoundTime struct {
 	TotalTimeMs        int64
 }
 
+type RangeTime struct {
+	Range       string
+	Code        int
+	Reused      bool // sent on the connection of the previous range
+	TtfbMs      uint32
+	TotalSize   int64
+	TotalTimeMs int64
+	Error       string
+}
+
 type Info struct {
+	StartTime          time.Time // wall clock, to line up the probes of several hosts
 	Server             network.TCPInfo
 	Client             network.TCPInfo
 	Domain             string
 	Ip                 string
 	Port               int
+	Zone               string // interface of an ipv6 link-local Ip
+	Geo                *GeoInfo
+	GeoError           string
+	Proxy              string // from the environment with EnvProxy, Ip is then the proxy's
+	Tos                int    // as requested with Pinger.Tos
+	LocalIp            string
+	LocalPort          int
 	Code               int
+	UnexpectedCode     bool   // Code is not one of Pinger.SuccessCodes
+	AttemptCodes       []int  // the code of each attempt with Pinger.RetryCodes, Code is the last
+	RedirectLocation   string // Location of the redirect refused by DenyRedirect
+	Status             string // verbatim, like "200 OK", the reason phrase may differ between servers
+	Proto              string // like "HTTP/1.1"
 	Hops               uint32
 	DnsTimeMs          uint32
 	ConnectTimeMs      uint32
 	TLSHandshakeTimeMs uint32
+	MutualTLS          bool   // the server asked for the client certificate and got it
+	SNI                string // server name sent in the tls handshake
+	TLSResumed         bool   // the handshake resumed a session of Pinger.TLSSessionCache
+	EyeballsWinner     string // family that won the Happy Eyeballs race, ipv4 or ipv6
+	EyeballsLeadMs     int64  // how much faster the winner connected, negative when the other was faster but started late
+	EyeballsRaced      bool   // the other family connected too, EyeballsLeadMs is only set then
 	TtfbMs             uint32
+	ServerTimingMs     map[string]float64 // durations from the Server-Timing header
+	Trailers           http.Header        // sent after a chunked body, like grpc-status
 	ReTransmitPackets  uint32
+	CongestionControl  string  // algorithm of the client side, like cubic or bbr, linux only
 	Speed              float32 // unit kb/s
 	TotalSize          int64
+	RequestBytes       int64 // written to the socket, request line, headers and body, for https encrypted after the handshake
+	SegmentsOut        uint64
+	SegmentsIn         uint64
+	DataSegmentsOut    uint64 // segments carrying data, the handshake and pure acks left out, zero on darwin
+	DataSegmentsIn     uint64
+	AvgSegmentSize     int64  // TotalSize / DataSegmentsIn, well below the mss hints at fragmentation, zero on darwin
+	SndMss             uint32 // effective mss of the connection, a small one clamped on the way throttles it
+	RcvMss             uint32 // mss of the server as seen from the segments received, linux only
 	TotalTimeMs        int64
+	DownloadTimeMs     int64 // first response byte to last byte
+	MaxStallMs         int64 // longest pause between two reads of the response
+	TimeToLastByteMs   int64 // request sent to last byte
+	CloseWaitMs        int64 // last byte to the server closing, with WaitClose, -1 when it did not close in time
+	ContentLength      int64
+	BodySize           int64
+	NoBody             bool // HEAD, 1xx, 204 or 304, nothing was read past the headers, TotalSize and Speed are 0
+	LengthMismatch     bool // body size differs from the declared Content-Length
+	Incomplete         bool // the body was cut short, by a reset or a short Content-Length
+	LifetimeExceeded   bool // closed by MaxConnDuration, TotalSize is what arrived before
+	PcapFile           string
+	PcapError          string
+	ExpectedHash       string
+	HashMatch          bool // Hash is ExpectedHash
+	AcceptEncoding     string
+	ContentEncoding    string
+	Decompressed       bool     // body was gunzipped by the transport, BodySize is decoded bytes
+	Connection         string   // Connection header of the response
+	KeepAlive          bool     // the server left the connection open for another request
+	Reused             bool     // sent on a connection kept by a Session, no handshake was paid
+	Intermediary       []string // signs of a proxy on the way, proxy headers, a bad certificate, few hops for the rtt
 	Error              string
 	PingError          string
+	PingErrorCode      PingErrorCode
+	PingRTTs           []PingRTT // each echo of the system ping, lost ones included
 	Hash               string
 	Loss               float32
-	Rounds             []RoundTime
+	Rounds             []RoundTime // the redirects followed, the final response is the Info itself
 }
 
 func (h *Info) String() string {
@@ -74,12 +307,13 @@ func minInt(x, y int) int {
 	}
 }
 
-func readN(b io.ReadCloser, toRead int, hasher hash.Hash) (err error) {
-	d := make([]byte, 64*1024)
+func readN(b io.ReadCloser, toRead int, hasher hash.Hash, bufSize int) (total int64, err error) {
+	d := make([]byte, bufSize)
 	var n int
 	for {
 		need := minInt(len(d), toRead)
 		n, err = b.Read(d[:need])
+		total += int64(n)
 		if hasher != nil && n > 0 {
 			hasher.Write(d[:n])
 		}
@@ -102,21 +336,23 @@ const (
 	infoSize = int(unsafe.Sizeof(network.TCPInfo{}))
 )
 
-func dealWithServerTcpInfo(b io.ReadCloser, contentLength int64, tcpInfo *network.TCPInfo) (err error) {
-	err = readN(b, int(contentLength)-infoSize, nil)
+func dealWithServerTcpInfo(b io.ReadCloser, contentLength int64, tcpInfo *network.TCPInfo, bufSize int) (total int64, err error) {
+	total, err = readN(b, int(contentLength)-infoSize, nil, bufSize)
 	if err != nil {
 		return
 	}
 	d := (*[infoSize]byte)(unsafe.Pointer(tcpInfo))[:]
-	_, err = io.ReadFull(b, d)
+	n, err := io.ReadFull(b, d)
+	total += int64(n)
 	return
 }
 
-func readAll(b io.ReadCloser, hasher hash.Hash) (err error) {
-	d := make([]byte, 64*1024)
+func readAll(b io.ReadCloser, hasher hash.Hash, bufSize int) (total int64, err error) {
+	d := make([]byte, bufSize)
 	var n int
 	for {
 		n, err = b.Read(d)
+		total += int64(n)
 		if hasher != nil && n > 0 {
 			hasher.Write(d[:n])
 		}
@@ -147,135 +383,791 @@ func PingSimple(url string) (*Info, error) {
 }
 
 func PingGet(url string, ping bool, srcAddr string) (*Info, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	u, err := ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 	return Ping(req, ping, srcAddr)
 }
 
-func sysPing(httpInfo *Info, addr, srcAddr string, wait chan<- int) {
-	p, err := command.Ping(addr, 1, 5, 1, srcAddr)
+// PingErrorCode classifies a failure of the system ping, so monitoring
+// does not depend on the wording of ping, which varies by os and locale.
+// It is zero when the ping did not fail and is named in json.
+type PingErrorCode int
+
+const (
+	// PingErrBinaryMissing is for no ping executable in PATH.
+	PingErrBinaryMissing PingErrorCode = iota + 1
+	// PingErrPermissionDenied is for a ping lacking the raw socket privilege.
+	PingErrPermissionDenied
+	// PingErrHostUnreachable is for an unknown host or only error replies.
+	PingErrHostUnreachable
+	// PingErrTimeout is for no reply in time, or the ping cancelled.
+	PingErrTimeout
+	// PingErrOther is for any other failure, PingError tells it.
+	PingErrOther
+)
+
+var pingErrorNames = map[PingErrorCode]string{
+	PingErrBinaryMissing:    "binary-missing",
+	PingErrPermissionDenied: "permission-denied",
+	PingErrHostUnreachable:  "host-unreachable",
+	PingErrTimeout:          "timeout",
+	PingErrOther:            "other",
+}
+
+func (c PingErrorCode) String() string {
+	if name, ok := pingErrorNames[c]; ok || c == 0 {
+		return name
+	}
+	return strconv.Itoa(int(c))
+}
+
+func (c PingErrorCode) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *PingErrorCode) UnmarshalText(text []byte) error {
+	for code, name := range pingErrorNames {
+		if name == string(text) {
+			*c = code
+			return nil
+		}
+	}
+	if len(text) == 0 {
+		*c = 0
+		return nil
+	}
+	v, err := strconv.Atoi(string(text))
+	if err != nil {
+		return fmt.Errorf("unknown ping error code %q", text)
+	}
+	*c = PingErrorCode(v)
+	return nil
+}
+
+// ErrPingNotAvailable is reported as PingError when there is no ping
+// executable, the http metrics are measured all the same.
+var ErrPingNotAvailable = errors.New("system ping not available, install iputils-ping or disable system ping (-p=false)")
+
+func pingErrorCode(err error) PingErrorCode {
+	var execErr *command.ExecError
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return PingErrBinaryMissing
+	case errors.Is(err, os.ErrPermission):
+		return PingErrPermissionDenied
+	case errors.Is(err, command.ErrUnknownHost):
+		return PingErrHostUnreachable
+	case errors.As(err, &execErr) && execErr.PermissionDenied():
+		return PingErrPermissionDenied
+	default:
+		return PingErrOther
+	}
+}
+
+// PingRTT is one echo of the system ping, like a reply line of ping.
+type PingRTT struct {
+	Seq      uint
+	RttMs    float64
+	TTL      uint
+	Received bool
+	Error    string // like "Destination Host Unreachable"
+}
+
+// PingResult is the system ping part of an Info, PingDone gets it apart
+// from the Info that Ping already returned.
+type PingResult struct {
+	Hops         uint32
+	RTTs         []PingRTT
+	Error        string
+	ErrorCode    PingErrorCode
+	Intermediary string // a proxy suspected from few hops for the rtt, empty when none
+}
+
+// Apply sets the ping fields of httpInfo, once nothing else reads it.
+func (r *PingResult) Apply(httpInfo *Info) {
+	httpInfo.Hops = r.Hops
+	httpInfo.PingError = r.Error
+	httpInfo.PingErrorCode = r.ErrorCode
+	httpInfo.PingRTTs = r.RTTs
+	if r.Intermediary != "" {
+		httpInfo.Intermediary = append(httpInfo.Intermediary, r.Intermediary)
+	}
+}
+
+func (p *Pinger) sysPing(addr, srcAddr string, wait chan<- PingResult) {
+	var r PingResult
+	count := p.pingCount()
+	run := p.PingFunc
+	if run == nil {
+		run = func(addr, srcAddr string, count int) (*command.PingOutput, error) {
+			return command.Ping(addr, 1, 5, count, srcAddr)
+		}
+	}
+	po, err := run(addr, srcAddr, count)
 	if err == nil {
-		if len(p.Replies) != 0 {
-			httpInfo.Hops = hops(p.Replies[0].TTL)
+		r.RTTs = pingRTTs(po.Replies, count)
+		var first *command.PingReply
+		for i := range po.Replies {
+			if po.Replies[i].Error == "" && !po.Replies[i].Duplicate {
+				first = &po.Replies[i]
+				break
+			}
+		}
+		if len(po.Replies) == 0 {
+			r.Error = "ping wait more than 5s"
+			r.ErrorCode = PingErrTimeout
+		} else if first == nil {
+			r.Error = po.Replies[0].Error
+			r.ErrorCode = PingErrHostUnreachable
 		} else {
-			httpInfo.PingError = "ping wait more than 5s"
+			r.Hops = hops(first.TTL)
 		}
 	} else {
-		httpInfo.PingError = err.Error()
+		r.Error = err.Error()
+		r.ErrorCode = pingErrorCode(err)
+		if r.ErrorCode == PingErrBinaryMissing {
+			r.Error = ErrPingNotAvailable.Error()
+		}
 	}
-	wait <- 1
+	wait <- r
 }
 
-func (p *Pinger) Ping() (*Info, error) {
-	pWait := make(chan int, 1)
-	var httpInfo Info
+// pingRTTs lines the replies up by sequence, an echo without a reply
+// was lost. Sequences start at 1, at 0 with the ping of darwin.
+func pingRTTs(replies []command.PingReply, count int) []PingRTT {
+	first := uint(1)
+	if runtime.GOOS == "darwin" {
+		first = 0
+	}
+	rtts := make([]PingRTT, count)
+	for i := range rtts {
+		rtts[i].Seq = first + uint(i)
+	}
+	for _, reply := range replies {
+		i := int(reply.SequenceNumber) - int(first)
+		if i < 0 || i >= count || reply.Duplicate || rtts[i].Received {
+			continue
+		}
+		if reply.Error != "" {
+			rtts[i].Error = reply.Error
+			continue
+		}
+		rtts[i].Received = true
+		rtts[i].TTL = reply.TTL
+		rtts[i].RttMs = float64(reply.Time.Microseconds()) / 1000
+	}
+	return rtts
+}
+
+// knownSchemes maps the schemes whose default port is known to the scheme
+// they are requested with, a websocket handshake is a plain http request.
+var knownSchemes = map[string]string{
+	"http":  "http",  // 80
+	"https": "https", // 443
+	"ws":    "http",  // 80
+	"wss":   "https", // 443
+}
+
+// schemePrefix matches a leading scheme, a "://" further on may be
+// part of the query, like host/x?next=http://a.
+var schemePrefix = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*://`)
+
+// ParseURL parses a url the way users type them, a bare host, host:port
+// or host/path is taken as http. url.Parse alone reads the host of
+// "localhost:8080" as a scheme and fails on "192.168.1.1:9000".
+func ParseURL(raw string) (*url.URL, error) {
+	if !schemePrefix.MatchString(raw) && !strings.HasPrefix(raw, "//") {
+		raw = "http://" + raw
+	}
+	return url.Parse(raw)
+}
+
+// hostAsScheme tells a url like "localhost:8080/x" that url.Parse
+// read as scheme "localhost" with the opaque "8080/x".
+func hostAsScheme(u *url.URL) bool {
+	if u.Opaque == "" {
+		return false
+	}
+	port, _, _ := strings.Cut(u.Opaque, "/")
+	_, err := strconv.ParseUint(port, 10, 16)
+	return err == nil
+}
+
+func (p *Pinger) normalizeURL() error {
 	u := p.Req.URL
-	var err error
-	if u.Scheme == "" {
-		u, err = url.Parse("http://" + u.String())
+	if u.Scheme == "" && u.Host != "" {
+		// scheme relative, //host/path
+		u.Scheme = "http"
+	} else if u.Scheme == "" || hostAsScheme(u) {
+		u, err := ParseURL(u.String())
 		if err != nil {
-			return nil, err
+			return err
 		}
 		p.Req.URL = u
 	}
+	u = p.Req.URL
+	scheme, ok := knownSchemes[strings.ToLower(u.Scheme)]
+	if !ok {
+		if u.Port() == "" {
+			return fmt.Errorf("cannot infer port for scheme %s, specify explicitly", u.Scheme)
+		}
+		return fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return ErrMissingHost
+	}
+	u.Scheme = scheme
+	return nil
+}
+
+// cloneRequest is req.Clone for sending req once more, the body is
+// opened again by GetBody since the clone shares the one already sent.
+// A body without GetBody, like a stream, can only be sent once.
+func cloneRequest(ctx context.Context, req *http.Request) *http.Request {
+	r := req.Clone(ctx)
+	if req.GetBody != nil {
+		r.Body, _ = req.GetBody()
+	}
+	return r
+}
+
+// ErrMissingHost is returned for urls like "/path" or "" that name no server.
+var ErrMissingHost = errors.New("missing host in URL")
+
+func (p *Pinger) newWrapper() *TcpWrapper {
+	w := &TcpWrapper{
+		localAddr:  p.SrcAddr,
+		ip:         p.ServerIp,
+		verifyHost: p.VerifyHost,
+		observer:   p.Observer,
+		clientCert: p.ClientCert,
+		rootCAs:    p.RootCAs,
+
+		connectTimeout: p.ConnectTimeout,
+		readTimeout:    p.ReadTimeout,
+		denyReserved:   p.DenyReserved,
+		doh:            p.DohUrl,
+		tos:            p.Tos,
+
+		maxConnDuration: p.MaxConnDuration,
+		pcapFile:        p.PcapFile,
+		overrides:       p.ResolveOverrides,
+		sessionCache:    p.TLSSessionCache,
+		debug:           p.Debug,
+		serverName:      p.ServerName,
+		resolver:        p.Resolver,
+		dialer:          p.Dialer,
+	}
+	if p.LocalPortFrom > 0 {
+		w.portFrom = p.LocalPortFrom
+		w.portTo = p.LocalPortTo
+		if w.portTo < w.portFrom {
+			w.portTo = w.portFrom
+		}
+	}
+	if p.Req != nil && p.Req.URL != nil {
+		w.ipHost = p.Req.URL.Hostname()
+	}
+	if proxy, _ := p.proxy(p.Req); proxy != nil {
+		w.ip = ""
+	}
+	if p.HappyEyeballs {
+		w.eyeballs = &eyeballs{}
+	}
+	return w
+}
+
+// ResolveTiming resolves host through the same path as Ping,
+// returning the address Ping would connect to and the lookup time.
+// ResolveOverrides are matched with the port of Req, 80 without one.
+func (p *Pinger) ResolveTiming(host string) (ip string, ms uint32, err error) {
+	port := "80"
+	if p.Req != nil && p.Req.URL != nil {
+		_, port, _ = net.SplitHostPort(canonicalAddr(p.Req))
+	}
+	w := p.newWrapper()
+	err = w.resolve(context.Background(), net.JoinHostPort(host, port))
+	if err != nil {
+		return "", 0, err
+	}
+	return w.remoteAddr.IP.String(), uint32(w.dnsTime.Milliseconds()), nil
+}
 
-	w := &TcpWrapper{localAddr: p.SrcAddr, ip: p.ServerIp, verifyHost: p.VerifyHost}
+func (p *Pinger) Ping() (*Info, error) {
+	if len(p.RetryCodes) != 0 && p.Retries > 0 {
+		return p.pingRetry()
+	}
+	return p.ping()
+}
+
+func (p *Pinger) ping() (*Info, error) {
+	pWait := make(chan PingResult, 1)
+	httpInfo := Info{StartTime: time.Now()}
+	err := p.normalizeURL()
+	if err != nil {
+		return nil, err
+	}
+	hasher := p.bodyHasher()
+	p.Debug.reset()
+
+	w := p.newWrapper()
 
 	if p.SysPing {
+		pingSrc := p.SrcAddr
+		if localAddr, err := resolveLocalAddr(p.SrcAddr); p.SrcAddr != "" && err == nil {
+			pingSrc = localAddr.IP.String()
+		}
 		w.ping = func(addr string) {
-			sysPing(&httpInfo, addr, p.SrcAddr, pWait)
+			p.sysPing(addr, pingSrc, pWait)
 		}
 	}
 
-	err = p.do(&httpInfo, w)
-	if err != nil {
+	defer w.Close()
+	err = p.do(&httpInfo, w, p.newClient(w), hasher)
+	w.stopCounting()
+	recordCapture(&httpInfo, w)
+	p.Debug.finish(w)
+	if err != nil && httpInfo.Code == 0 {
+		// no response at all, nothing was measured past the handshake
+		p.Observer.complete(&httpInfo)
+		if p.SysPing && p.PingDone != nil {
+			p.PingDone(&httpInfo, PingResult{})
+		}
 		return &httpInfo, nil
 	}
 
+	finish(&httpInfo, w, w.connectStart)
+	p.waitClose(&httpInfo, w)
+	recordLead(&httpInfo, w)
+	if p.SysPing && p.PingDone == nil {
+		r := p.waitPing(pWait, httpInfo.Client.RttMs)
+		r.Apply(&httpInfo)
+	}
+	p.recordHash(&httpInfo, hasher)
+	p.Observer.complete(&httpInfo)
+	if p.SysPing && p.PingDone != nil {
+		rttMs := httpInfo.Client.RttMs
+		go func() {
+			p.PingDone(&httpInfo, p.waitPing(pWait, rttMs))
+		}()
+	}
+
+	return &httpInfo, nil
+}
+
+// bodyHasher is the hasher of one ping, BodyHasher started over or a
+// sha256 of its own for ExpectedHash, nil when the body is not hashed.
+func (p *Pinger) bodyHasher() hash.Hash {
+	if p.BodyHasher != nil {
+		p.BodyHasher.Reset()
+		return p.BodyHasher
+	}
+	if p.ExpectedHash != "" {
+		return sha256.New()
+	}
+	return nil
+}
+
+func (p *Pinger) recordHash(httpInfo *Info, hasher hash.Hash) {
+	if hasher == nil {
+		return
+	}
+	httpInfo.Hash = hex.EncodeToString(hasher.Sum(nil))
+	if p.ExpectedHash != "" {
+		httpInfo.ExpectedHash = p.ExpectedHash
+		httpInfo.HashMatch = strings.EqualFold(httpInfo.Hash, p.ExpectedHash)
+	}
+}
+
+// waitPing takes the rtt of the connection to tell few hops for it.
+func (p *Pinger) waitPing(pWait <-chan PingResult, rttMs uint32) PingResult {
+	select {
+	case r := <-pWait:
+		r.Intermediary = hopsIntermediary(r.Hops, rttMs)
+		return r
+	case <-p.Req.Context().Done():
+		return PingResult{Error: "ping cancelled: " + p.Req.Context().Err().Error(), ErrorCode: PingErrTimeout}
+	}
+}
+
+// waitClose runs after finish, the wait is not part of TotalTimeMs.
+func (p *Pinger) waitClose(httpInfo *Info, w *TcpWrapper) {
+	if p.WaitClose > 0 && httpInfo.Error == "" {
+		httpInfo.CloseWaitMs = w.waitEOF(p.WaitClose)
+	}
+}
+
+func finish(httpInfo *Info, w *TcpWrapper, start time.Time) {
 	endTime := time.Now()
 	httpInfo.TotalSize = w.count
-	httpInfo.TotalTimeMs = endTime.Sub(w.connectStart).Milliseconds()
+	httpInfo.RequestBytes = w.writeCount
+	if httpInfo.DataSegmentsIn != 0 {
+		httpInfo.AvgSegmentSize = httpInfo.TotalSize / int64(httpInfo.DataSegmentsIn)
+	}
+	httpInfo.TotalTimeMs = endTime.Sub(start).Milliseconds()
 	//use last write to calculate download speed to avoid small request that firstRead == endTime
 	t := endTime.Sub(w.lastWrite).Milliseconds() - int64(httpInfo.Client.RttMs)
 	if t <= 0 {
 		t = 1
 	}
 	httpInfo.Speed = float32(float64(w.count) / float64(t))
-	if p.SysPing {
-		<-pWait
+	if httpInfo.NoBody {
+		// header bytes alone make no download speed
+		httpInfo.TotalSize = 0
+		httpInfo.Speed = 0
 	}
-	if p.BodyHasher != nil {
-		httpInfo.Hash = hex.EncodeToString(p.BodyHasher.Sum(nil))
+	if w.firstRead != nil {
+		httpInfo.DownloadTimeMs = endTime.Sub(*w.firstRead).Milliseconds()
+		httpInfo.MaxStallMs = w.maxStall.Milliseconds()
+	}
+	if w.firstWrite != nil {
+		httpInfo.TimeToLastByteMs = endTime.Sub(*w.firstWrite).Milliseconds()
 	}
+}
 
-	return &httpInfo, nil
+// PingBatch runs the pingers concurrently under one deadline, a probe still
+// running when it passes is cancelled and reports what it measured so far.
+// A Debug or BodyHasher shared by several pingers is not used.
+func PingBatch(pingers []*Pinger, deadline time.Duration) []*Info {
+	ctx := context.Background()
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+	infos := make([]*Info, len(pingers))
+	debugs := make(map[*Debug]int)
+	hashers := make(map[hash.Hash]int)
+	for _, p := range pingers {
+		if p.Debug != nil {
+			debugs[p.Debug]++
+		}
+		if p.BodyHasher != nil {
+			hashers[p.BodyHasher]++
+		}
+	}
+	var wg sync.WaitGroup
+	for i, p := range pingers {
+		wg.Add(1)
+		go func(i int, p Pinger) {
+			defer wg.Done()
+			p.Req = cloneRequest(ctx, p.Req)
+			if debugs[p.Debug] > 1 {
+				// the events of pings running at once cannot be told apart
+				p.Debug = nil
+			}
+			if p.BodyHasher != nil && hashers[p.BodyHasher] > 1 {
+				// the bodies would be hashed into one another
+				p.BodyHasher = nil
+			}
+			info, err := p.Ping()
+			if err != nil {
+				info = &Info{Error: err.Error()}
+			}
+			if ctx.Err() != nil && info.Error != "" {
+				info.Error = "batch deadline exceeded: " + info.Error
+			}
+			infos[i] = info
+		}(i, *p)
+	}
+	wg.Wait()
+	return infos
+}
+
+// PingAllIPs runs the measurement against every address the host resolves to,
+// connecting to each ip directly while keeping the host for Host and SNI.
+func (p *Pinger) PingAllIPs() ([]*Info, error) {
+	err := p.normalizeURL()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	if ip, ok := p.ResolveOverrides[strings.ToLower(canonicalAddr(p.Req))]; ok {
+		ips = []net.IP{net.ParseIP(ip)}
+	} else {
+		ips, err = p.lookupIP(p.Req.URL.Hostname())
+		if err != nil {
+			return nil, err
+		}
+	}
+	infos := make([]*Info, 0, len(ips))
+	for _, ip := range ips {
+		sub := *p
+		sub.Req = cloneRequest(p.Req.Context(), p.Req)
+		sub.ServerIp = ip.String()
+		info, err := sub.Ping()
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
 }
 
-func (p *Pinger) do(httpInfo *Info, w *TcpWrapper) error {
-	client := &http.Client{
-		Transport: &http.Transport{DialContext: w.Dial, DialTLSContext: w.DialTLS},
+// lookupIP finds the addresses of host the way a dial does, through DoH
+// then the Resolver.
+func (p *Pinger) lookupIP(host string) ([]net.IP, error) {
+	if p.DohUrl != "" {
+		return dohLookup(p.DohUrl, host)
+	}
+	if p.Resolver != nil {
+		return p.Resolver(p.Req.Context(), host)
+	}
+	return net.LookupIP(host)
+}
+
+func (p *Pinger) newClient(w *TcpWrapper) *http.Client {
+	var transport http.RoundTripper = &http.Transport{
+		DialContext:        w.Dial,
+		DialTLSContext:     w.DialTLS,
+		DisableCompression: p.AcceptEncoding != "",
+		Proxy:              p.proxy,
+		// used for https inside a proxy tunnel, DialTLS is not
+		TLSClientConfig: w.tlsConfig(w.serverName),
+	}
+	if p.Http10 {
+		transport = &http10Transport{w: w}
+	}
+	return &http.Client{
+		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if p.Redirect {
-				return nil
+			if !p.Redirect || p.DenyRedirect || len(via) > p.maxRedirects() || (len(p.SuccessCodes) != 0 && p.success(req.Response.StatusCode)) {
+				return http.ErrUseLastResponse
 			}
-			return http.ErrUseLastResponse
+			w.recordHop(via[len(via)-1].URL.String(), req.Response.StatusCode)
+			return nil
 		}, Timeout: p.Timeout,
 	}
-	if p.ServerSupport {
-		p.Req.Header.Set("X-HTTPPING-REQUIRE", "TCPINFO")
+}
+
+// PingRanges requests each range in turn over one keep-alive connection,
+// the way a player seeks, ranges are given like "0-1023" without "bytes=".
+func (p *Pinger) PingRanges(ranges []string) ([]RangeTime, error) {
+	err := p.normalizeURL()
+	if err != nil {
+		return nil, err
+	}
+	w := p.newWrapper()
+	defer w.Close()
+	client := p.newClient(w)
+
+	times := make([]RangeTime, 0, len(ranges))
+	for _, r := range ranges {
+		rt := RangeTime{Range: r}
+		req := cloneRequest(p.Req.Context(), p.Req)
+		req.Header.Set("Range", "bytes="+r)
+		prevConnect := w.connectStart
+		w.firstRead = nil
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			rt.Error = err.Error()
+			times = append(times, rt)
+			continue
+		}
+		rt.Code = resp.StatusCode
+		rt.Reused = !prevConnect.IsZero() && w.connectStart == prevConnect
+		rt.TtfbMs = uint32(w.TTFB().Milliseconds())
+		// drain the body so the connection goes back for the next range
+		rt.TotalSize, err = readAll(resp.Body, nil, p.readBufferSize())
+		_ = resp.Body.Close()
+		rt.TotalTimeMs = time.Since(start).Milliseconds()
+		if err != nil {
+			rt.Error = err.Error()
+		}
+		times = append(times, rt)
 	}
+	return times, nil
+}
 
-	resp, err := client.Do(p.Req)
+func recordRemote(httpInfo *Info, w *TcpWrapper) {
 	httpInfo.Domain = w.domain
 	if w.remoteAddr != nil {
 		httpInfo.Ip = w.remoteAddr.IP.String()
 		httpInfo.Port = w.remoteAddr.Port
+		httpInfo.Zone = w.remoteAddr.Zone
 		httpInfo.DnsTimeMs = uint32(w.dnsTime.Milliseconds())
 	}
+}
+
+// pcapPart names the capture of one connection of several, cap.pcap
+// becomes cap.part.pcap.
+func pcapPart(file, part string) string {
+	if file == "" {
+		return ""
+	}
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "." + part + ext
+}
 
+func recordCapture(httpInfo *Info, w *TcpWrapper) {
+	w.stopCapture()
+	if w.pcapFile == "" {
+		return
+	}
+	httpInfo.PcapError = w.pcapError
+	if w.pcapError == "" {
+		httpInfo.PcapFile = w.pcapFile
+	}
+}
+
+func recordConn(httpInfo *Info, w *TcpWrapper) {
+	if localAddr, ok := w.d.LocalAddr().(*net.TCPAddr); ok {
+		httpInfo.LocalIp = localAddr.IP.String()
+		httpInfo.LocalPort = localAddr.Port
+	}
+	httpInfo.ConnectTimeMs = uint32(w.tcpHandshake.Milliseconds())
+	httpInfo.TLSHandshakeTimeMs = uint32(w.tlsHandshake.Milliseconds())
+	httpInfo.MutualTLS = w.certSent
+	httpInfo.TLSResumed = w.tlsResumed
+	httpInfo.SNI = w.sni
+	httpInfo.Tos = w.tos
+	httpInfo.CongestionControl = w.congestion
+	if w.certProblem != "" {
+		httpInfo.Intermediary = append(httpInfo.Intermediary, w.certProblem)
+	}
+	if w.eyeballs != nil {
+		httpInfo.EyeballsWinner = family(w.remoteAddr.IP)
+	}
+}
+
+// recordLead runs once the measurement is done, the loser of the race
+// may still be connecting and waiting for it is not part of TotalTimeMs.
+func recordLead(httpInfo *Info, w *TcpWrapper) {
+	if httpInfo.EyeballsWinner == "" {
+		return
+	}
+	// the loser started at the latest after the head start of the winner
+	httpInfo.EyeballsLeadMs, httpInfo.EyeballsRaced = w.eyeballs.leadMs(connectionAttemptDelay + w.dialTimeout())
+}
+
+func (p *Pinger) do(httpInfo *Info, w *TcpWrapper, client *http.Client, hasher hash.Hash) error {
+	defer func() {
+		httpInfo.LifetimeExceeded = w.lifetimeExceeded.Load()
+	}()
+	if p.ServerSupport {
+		p.Req.Header.Set("X-HTTPPING-REQUIRE", "TCPINFO")
+	}
+	if p.AcceptEncoding != "" {
+		p.Req.Header.Set("Accept-Encoding", p.AcceptEncoding)
+	}
+
+	req := p.Req
+	if proxy, _ := p.proxy(req); proxy != nil {
+		httpInfo.Proxy = proxy.Redacted()
+		if req.URL.Scheme == "https" {
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), w.proxyTrace()))
+		}
+	}
+	resp, err := client.Do(req)
+	recordRemote(httpInfo, w)
+	p.recordGeo(httpInfo)
 	if err != nil {
 		httpInfo.Error = err.Error()
 		return err
 	}
-	httpInfo.ConnectTimeMs = uint32(w.tcpHandshake.Milliseconds())
-	httpInfo.TLSHandshakeTimeMs = uint32(w.tlsHandshake.Milliseconds())
+	recordConn(httpInfo, w)
 	httpInfo.TtfbMs = uint32(w.TTFB().Milliseconds())
+	p.Observer.firstByte(w.TTFB())
 
-	defer w.Close()
+	resp.Body = p.progressBody(resp.Body, w.connectStart)
 	defer resp.Body.Close()
 	httpInfo.Code = resp.StatusCode
+	httpInfo.UnexpectedCode = !p.success(resp.StatusCode)
+	httpInfo.Status = resp.Status
+	httpInfo.Proto = resp.Proto
+	httpInfo.Connection = resp.Header.Get("Connection")
+	if httpInfo.Connection == "" && resp.Close {
+		// net/http takes the close token out of the header
+		httpInfo.Connection = "close"
+	}
+	httpInfo.KeepAlive = !resp.Close
+	httpInfo.Intermediary = append(httpInfo.Intermediary, headerIntermediary(resp.Header)...)
+	httpInfo.ServerTimingMs = parseServerTiming(resp.Header.Values("Server-Timing"))
+	httpInfo.AcceptEncoding = p.AcceptEncoding
+	httpInfo.ContentEncoding = resp.Header.Get("Content-Encoding")
+	if resp.Uncompressed {
+		// the transport asked for gzip itself and already stripped it
+		httpInfo.AcceptEncoding = "gzip"
+		httpInfo.ContentEncoding = "gzip"
+		httpInfo.Decompressed = true
+	}
 	var done string
 	if p.ServerSupport {
 		done = resp.Header.Get("X-HTTPPING-TCPINFO")
 	}
-	if done != "" && resp.ContentLength > 0 {
-		err = dealWithServerTcpInfo(resp.Body, resp.ContentLength, &httpInfo.Server)
+	var bodySize int64
+	// Content-Length of a HEAD may announce the body a GET would get,
+	// there is none to wait for
+	httpInfo.NoBody = noBody(resp)
+	if httpInfo.NoBody {
+		bodySize = 0
+	} else if done != "" && resp.ContentLength > 0 {
+		bodySize, err = dealWithServerTcpInfo(resp.Body, resp.ContentLength, &httpInfo.Server, p.readBufferSize())
 	} else if resp.ContentLength > 0 {
-		err = readN(resp.Body, int(resp.ContentLength), p.BodyHasher)
+		bodySize, err = readN(resp.Body, int(resp.ContentLength), hasher, p.readBufferSize())
 	} else {
-		err = readAll(resp.Body, p.BodyHasher)
+		bodySize, err = readAll(resp.Body, hasher, p.readBufferSize())
 	}
 	if err == io.EOF {
 		err = nil
 	}
-	if err != nil {
-		httpInfo.Error = err.Error()
-		return err
+	httpInfo.ContentLength = resp.ContentLength
+	httpInfo.BodySize = bodySize
+	// net/http stops at Content-Length and drops anything beyond it,
+	// so only a short body can be observed here.
+	if !httpInfo.NoBody && resp.ContentLength >= 0 && bodySize != resp.ContentLength {
+		httpInfo.LengthMismatch = true
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
 	}
+	readErr := err
+	if readErr != nil {
+		httpInfo.Error = readErr.Error()
+	}
+	httpInfo.Trailers = trailers(resp.Trailer)
+	// TotalSize and Speed still cover the bytes received before the failure
+	httpInfo.Incomplete = readErr != nil || (httpInfo.LengthMismatch && bodySize < resp.ContentLength)
 	if w.rounds != nil {
 		httpInfo.Rounds = w.rounds
 	}
 
-	tcpInfo, err := w.CommonInfo()
-	if err != nil {
-		httpInfo.Error = err.Error()
-	} else {
-		httpInfo.Client = *tcpInfo
+	// the connection is still open after a failed read, keep its tcp info,
+	// a fake of Pinger.Dialer that is not tcp has none to give
+	if w.tcpConn() != nil {
+		tcpInfo, ext, err := w.tcpInfo()
+		if err != nil {
+			if readErr == nil {
+				httpInfo.Error = err.Error()
+			}
+		} else {
+			httpInfo.Client = *tcpInfo
+			httpInfo.SegmentsOut = ext.SegsOut
+			httpInfo.SegmentsIn = ext.SegsIn
+			httpInfo.DataSegmentsOut = ext.DataSegsOut
+			httpInfo.DataSegmentsIn = ext.DataSegsIn
+			httpInfo.SndMss = ext.SndMss
+			httpInfo.RcvMss = ext.RcvMss
+		}
+	}
+	if p.DenyRedirect && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		httpInfo.RedirectLocation = resp.Header.Get("Location")
+		if readErr == nil {
+			httpInfo.Error = fmt.Sprintf("redirect denied: %d to %s", resp.StatusCode, httpInfo.RedirectLocation)
+		}
+	}
+	if readErr != nil {
+		return readErr
 	}
 
-	if done != "" && resp.ContentLength != 0 {
+	if done != "" && resp.ContentLength != 0 && !httpInfo.NoBody {
 		if httpInfo.Server.TotalPackets == 0 {
 			httpInfo.Server.TotalPackets = uint32(w.count / 1460)
 			if httpInfo.Server.TotalPackets == 0 {
@@ -287,16 +1179,34 @@ func (p *Pinger) do(httpInfo *Info, w *TcpWrapper) error {
 			httpInfo.ReTransmitPackets = httpInfo.Server.ReTransmitPackets
 		}
 	}
-	return err
+	return nil
+}
+
+// trailers keeps the trailers that came, resp.Trailer is only complete once
+// the body is read to the end and holds nil for those announced but not sent.
+func trailers(trailer http.Header) http.Header {
+	var t http.Header
+	for k, v := range trailer {
+		if v == nil {
+			continue
+		}
+		if t == nil {
+			t = make(http.Header)
+		}
+		t[k] = v
+	}
+	return t
+}
+
+// noBody tells the responses that never carry a body, whatever their headers say.
+func noBody(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return true
+	}
+	code := resp.StatusCode
+	return code < 200 || code == http.StatusNoContent || code == http.StatusNotModified
 }
 
 func Ping(req *http.Request, ping bool, srcAddr string) (*Info, error) {
-	pinger := Pinger{
-		Req:           req,
-		SysPing:       ping,
-		SrcAddr:       srcAddr,
-		ServerSupport: false,
-		BodyHasher:    nil,
-	}
-	return pinger.Ping()
+	return PingWith(req, WithSysPing(ping), WithSrcAddr(srcAddr))
 }
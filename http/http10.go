@@ -0,0 +1,119 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// http10Transport sends requests as HTTP/1.0 over the TcpWrapper, one
+// connection per request, the standard transport always speaks HTTP/1.1.
+type http10Transport struct {
+	w *TcpWrapper
+}
+
+func canonicalAddr(r *http.Request) string {
+	port := r.URL.Port()
+	if port == "" {
+		port = "80"
+		if r.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(r.URL.Hostname(), port)
+}
+
+func (t *http10Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn net.Conn
+	var err error
+	if req.URL.Scheme == "https" {
+		conn, err = t.w.DialTLS(req.Context(), "tcp", canonicalAddr(req))
+	} else {
+		conn, err = t.w.Dial(req.Context(), "tcp", canonicalAddr(req))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body := &connBody{conn: conn, done: make(chan struct{})}
+	go func() {
+		// the client only cancels through the context, unblock pending reads
+		select {
+		case <-req.Context().Done():
+			_ = conn.Close()
+		case <-body.done:
+		}
+	}()
+
+	err = writeRequest10(conn, req)
+	if err != nil {
+		_ = body.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		_ = body.Close()
+		return nil, err
+	}
+	body.ReadCloser = resp.Body
+	resp.Body = body
+	return resp, nil
+}
+
+func writeRequest10(conn net.Conn, req *http.Request) error {
+	var content []byte
+	if req.Body != nil {
+		// HTTP/1.0 has no chunked encoding, the length must be known up front
+		var err error
+		content, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	bw := bufio.NewWriter(conn)
+	fmt.Fprintf(bw, "%s %s HTTP/1.0\r\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(bw, "Host: %s\r\n", host)
+	if req.Header.Get("User-Agent") == "" {
+		fmt.Fprintf(bw, "User-Agent: Go-http-client/1.0\r\n")
+	}
+	if len(content) != 0 {
+		fmt.Fprintf(bw, "Content-Length: %d\r\n", len(content))
+	}
+	err := req.Header.WriteSubset(bw, map[string]bool{"Host": true, "Content-Length": true})
+	if err != nil {
+		return err
+	}
+	bw.WriteString("\r\n")
+	_, _ = io.Copy(bw, bytes.NewReader(content))
+	return bw.Flush()
+}
+
+// connBody closes the connection together with the response body.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (b *connBody) Close() error {
+	var err error
+	b.once.Do(func() {
+		if b.ReadCloser != nil {
+			_ = b.ReadCloser.Close()
+		}
+		err = b.conn.Close()
+		close(b.done)
+	})
+	return err
+}
@@ -1,8 +1,24 @@
 package http
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/qiniu/httpping/command"
+	"github.com/qiniu/httpping/network"
 )
 import "github.com/stretchr/testify/assert"
 
@@ -12,3 +28,449 @@ func TestHttp(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, h)
 }
+
+func TestParseServerTiming(t *testing.T) {
+	timing := parseServerTiming([]string{`cache;desc="Cache, Read";dur=23.2, db;dur=53`, "miss, total;dur=\"1.5\""})
+	assert.Equal(t, map[string]float64{"cache": 23.2, "db": 53, "miss": 0, "total": 1.5}, timing)
+	assert.Nil(t, parseServerTiming(nil))
+}
+
+func TestStats(t *testing.T) {
+	s := NewStats([]uint32{10, 50})
+	for i := 1; i <= 100; i++ {
+		s.Add(&Info{TtfbMs: uint32(i)})
+	}
+	s.Add(&Info{Error: "refused"})
+	assert.Equal(t, 101, s.Count)
+	assert.Equal(t, 1, s.Errors)
+	assert.Equal(t, float64(1), s.TtfbMs.Min)
+	assert.Equal(t, float64(100), s.TtfbMs.Max)
+	assert.Equal(t, 50.5, s.TtfbMs.Avg)
+	assert.Equal(t, float64(50), s.TtfbMs.P50)
+	assert.Equal(t, float64(95), s.TtfbMs.P95)
+	assert.Equal(t, float64(99), s.TtfbMs.P99)
+	assert.Equal(t, []uint32{10, 40, 50}, s.TtfbMs.Histogram)
+
+	// a long run keeps a bounded sample for the percentiles
+	var long Summary
+	for i := 1; i <= 3*maxSamples; i++ {
+		long.add(float64(i), nil)
+	}
+	assert.Len(t, long.samples, maxSamples)
+	assert.Equal(t, float64(1), long.Min)
+	assert.Equal(t, float64(3*maxSamples), long.Max)
+	assert.InDelta(t, 1.5*maxSamples, long.P50, 0.1*maxSamples)
+}
+
+// TestServerSupport runs the server side of ServerSupport the way
+// cmd/demo does, the trailer carries a fixed TCPInfo so the loss is known.
+func TestServerSupport(t *testing.T) {
+	trailer := network.TCPInfo{RttMs: 7, RttVarMs: 3}
+	const length = 100 * 1024
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(length))
+		if r.Header.Get("X-HTTPPING-REQUIRE") != "TCPINFO" {
+			_, _ = w.Write(make([]byte, length))
+			return
+		}
+		w.Header().Set("X-HTTPPING-TCPINFO", "DONE")
+		_, _ = w.Write(make([]byte, length-infoSize))
+		info := trailer
+		_, _ = w.Write((*[infoSize]byte)(unsafe.Pointer(&info))[:])
+	}))
+	defer server.Close()
+
+	ping := func(serverSupport bool) *Info {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		assert.Nil(t, err)
+		p := Pinger{Req: req, ServerSupport: serverSupport}
+		info, err := p.Ping()
+		assert.Nil(t, err)
+		assert.Equal(t, "", info.Error)
+		assert.Equal(t, int64(length), info.BodySize)
+		return info
+	}
+
+	trailer.ReTransmitPackets, trailer.TotalPackets = 5, 200
+	info := ping(true)
+	assert.Equal(t, trailer, info.Server)
+	assert.Equal(t, uint32(5), info.ReTransmitPackets)
+	assert.Equal(t, float32(2.5), info.Loss)
+
+	// a server that cannot count its packets leaves it to the client
+	trailer.TotalPackets = 0
+	info = ping(true)
+	assert.Equal(t, uint32(info.TotalSize/1460), info.Server.TotalPackets)
+	assert.Equal(t, float32(5)/float32(info.Server.TotalPackets)*100, info.Loss)
+
+	info = ping(false)
+	assert.Equal(t, network.TCPInfo{}, info.Server)
+	assert.Equal(t, float32(0), info.Loss)
+}
+
+func TestPingRTTs(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("darwin sequences start at 0")
+	}
+	rtts := pingRTTs([]command.PingReply{
+		{SequenceNumber: 1, TTL: 52, Time: 12500 * time.Microsecond},
+		{SequenceNumber: 1, TTL: 52, Time: 13 * time.Millisecond, Duplicate: true},
+		{SequenceNumber: 3, Error: "Destination Host Unreachable"},
+	}, 3)
+	assert.Equal(t, []PingRTT{
+		{Seq: 1, RttMs: 12.5, TTL: 52, Received: true},
+		{Seq: 2},
+		{Seq: 3, Error: "Destination Host Unreachable"},
+	}, rtts)
+}
+
+type fakeConn struct {
+	net.Conn
+}
+
+// TestInjected runs a ping of a name that does not exist, resolved,
+// dialed and pinged by the fakes of the Pinger.
+func TestInjected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pong"))
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	var dialed string
+	req, err := http.NewRequest(http.MethodGet, "http://fake.test:"+port, nil)
+	assert.Nil(t, err)
+	p := Pinger{
+		Req:     req,
+		SysPing: true,
+		Resolver: func(ctx context.Context, host string) ([]net.IP, error) {
+			assert.Equal(t, "fake.test", host)
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		},
+		Dialer: func(ctx context.Context, d *net.Dialer, address string) (net.Conn, error) {
+			dialed = address
+			conn, err := d.DialContext(ctx, "tcp", address)
+			if err != nil {
+				return nil, err
+			}
+			// a fake is no *net.TCPConn
+			return fakeConn{conn}, nil
+		},
+		PingFunc: func(addr, srcAddr string, count int) (*command.PingOutput, error) {
+			return &command.PingOutput{Replies: []command.PingReply{{SequenceNumber: 1, TTL: 60}}}, nil
+		},
+	}
+	info, err := p.Ping()
+	assert.Nil(t, err)
+	assert.Equal(t, "", info.Error)
+	assert.Equal(t, "127.0.0.1:"+port, dialed)
+	assert.Equal(t, "fake.test", info.Domain)
+	assert.Equal(t, int64(4), info.BodySize)
+	assert.Equal(t, uint32(4), info.Hops)
+}
+
+// TestDnsConnectSeparate checks that each resolution mode keeps the lookup
+// out of ConnectTimeMs and the connect out of DnsTimeMs.
+func TestDnsConnectSeparate(t *testing.T) {
+	const dnsDelay, connectDelay = 100 * time.Millisecond, 30 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(dnsDelay)
+		if r.URL.Query().Get("type") == "1" {
+			_, _ = w.Write([]byte(`{"Status":0,"Answer":[{"type":1,"data":"127.0.0.1"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"Status":0}`))
+	}))
+	defer doh.Close()
+
+	ping := func(host string, set func(p *Pinger)) *Info {
+		req, err := http.NewRequest(http.MethodGet, "http://"+net.JoinHostPort(host, port), nil)
+		assert.Nil(t, err)
+		p := Pinger{
+			Req: req,
+			Dialer: func(ctx context.Context, d *net.Dialer, address string) (net.Conn, error) {
+				conn, err := d.DialContext(ctx, "tcp", address)
+				if err == nil {
+					// only once, a local port in use is retried with another
+					time.Sleep(connectDelay)
+				}
+				return conn, err
+			},
+		}
+		set(&p)
+		info, err := p.Ping()
+		assert.Nil(t, err)
+		assert.Equal(t, "", info.Error)
+		assert.GreaterOrEqual(t, info.ConnectTimeMs, uint32(connectDelay.Milliseconds()))
+		return info
+	}
+	slow := uint32(dnsDelay.Milliseconds())
+
+	info := ping("localhost", func(p *Pinger) {})
+	assert.Less(t, info.DnsTimeMs, uint32(connectDelay.Milliseconds()))
+
+	info = ping("fake.test", func(p *Pinger) {
+		p.ResolveOverrides = map[string]string{"fake.test:" + port: "127.0.0.1"}
+	})
+	assert.Equal(t, uint32(0), info.DnsTimeMs)
+
+	for _, set := range []func(p *Pinger){
+		func(p *Pinger) {
+			p.Resolver = func(ctx context.Context, host string) ([]net.IP, error) {
+				time.Sleep(dnsDelay)
+				return []net.IP{net.ParseIP("127.0.0.1")}, nil
+			}
+		},
+		func(p *Pinger) { p.DohUrl = doh.URL },
+	} {
+		info = ping("fake.test", set)
+		assert.GreaterOrEqual(t, info.DnsTimeMs, slow)
+		assert.Less(t, info.ConnectTimeMs, slow)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	for raw, want := range map[string]string{
+		"localhost:8080":    "http://localhost:8080",
+		"localhost:8080/x":  "http://localhost:8080/x",
+		"example.com/x":     "http://example.com/x",
+		"192.168.1.1:9000":  "http://192.168.1.1:9000",
+		"[::1]:80/x?y=1":    "http://[::1]:80/x?y=1",
+		"https://host:8443": "https://host:8443",
+		"//host/path":       "//host/path",
+		// a url in the query is no scheme
+		"localhost:18081/x?next=http://a": "http://localhost:18081/x?next=http://a",
+		"example.com/x?u=http://a":        "http://example.com/x?u=http://a",
+	} {
+		u, err := ParseURL(raw)
+		assert.Nil(t, err, raw)
+		assert.Equal(t, want, u.String(), raw)
+	}
+
+	// urls parsed by the caller come in with the host taken for a scheme
+	for raw, host := range map[string]string{
+		"localhost:8080/x": "localhost:8080",
+		"example.com/x":    "example.com",
+		"//host/path":      "host",
+
+		"localhost:18081/x?next=http://a": "localhost:18081",
+		"example.com/x?u=http://a":        "example.com",
+	} {
+		req, err := http.NewRequest(http.MethodGet, raw, nil)
+		assert.Nil(t, err, raw)
+		p := Pinger{Req: req}
+		assert.Nil(t, p.normalizeURL(), raw)
+		assert.Equal(t, "http", p.Req.URL.Scheme, raw)
+		assert.Equal(t, host, p.Req.URL.Host, raw)
+	}
+}
+
+// TestWaitClose has a keep-alive server close the connection a while after
+// the body, the transport is still reading it when the ping is measured.
+func TestWaitClose(t *testing.T) {
+	const closeDelay = 50 * time.Millisecond
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Read(make([]byte, 4096))
+		_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\npong"))
+		time.Sleep(closeDelay)
+		_ = conn.Close()
+	}()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String(), nil)
+	assert.Nil(t, err)
+	p := Pinger{Req: req, WaitClose: time.Second, Debug: &Debug{}}
+	info, err := p.Ping()
+	assert.Nil(t, err)
+	assert.Equal(t, "", info.Error)
+	assert.Equal(t, int64(4), info.BodySize)
+	assert.GreaterOrEqual(t, info.CloseWaitMs, closeDelay.Milliseconds()-5)
+	assert.Less(t, info.CloseWaitMs, time.Second.Milliseconds())
+	// the read seeing the close comes after the ping is logged
+	for _, e := range p.Debug.Events {
+		assert.Less(t, e.AtUs, time.Second.Microseconds())
+		assert.Equal(t, "", e.Error)
+	}
+}
+
+// TestSessionServerIp checks that a redial of a session still goes to
+// ServerIp instead of looking up the host.
+func TestSessionServerIp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	assert.Nil(t, err)
+	s := NewSession(Pinger{ServerIp: host})
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, "http://unresolvable.invalid:"+port, nil)
+		assert.Nil(t, err)
+		info, err := s.Ping(req)
+		assert.Nil(t, err)
+		assert.Equal(t, "", info.Error)
+		assert.Equal(t, 200, info.Code)
+		server.CloseClientConnections()
+	}
+}
+
+// TestSessionIdle checks that ReadTimeout does not close the connection of
+// a session idle between pings.
+func TestSessionIdle(t *testing.T) {
+	const readTimeout = 50 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	s := NewSession(Pinger{ReadTimeout: readTimeout})
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		assert.Nil(t, err)
+		info, err := s.Ping(req)
+		assert.Nil(t, err)
+		assert.Equal(t, "", info.Error)
+		assert.Equal(t, i > 0, info.Reused)
+		time.Sleep(2 * readTimeout)
+	}
+}
+
+// TestRepeatBody checks that each ping of a Repeater sends the whole body.
+func TestRepeatBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "hello" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("hello"))
+	assert.Nil(t, err)
+	r := Repeater{Pinger: Pinger{Req: req}, Count: 3}
+	var codes []int
+	r.Run(context.Background(), func(info *Info, stats *Stats) {
+		codes = append(codes, info.Code)
+	})
+	assert.Equal(t, []int{200, 200, 200}, codes)
+}
+
+// TestExpectedHash pings twice with one Pinger, each body is hashed on its own.
+func TestExpectedHash(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pong"))
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	assert.Nil(t, err)
+	sum := sha256.Sum256([]byte("pong"))
+	p := Pinger{Req: req, ExpectedHash: hex.EncodeToString(sum[:])}
+	for i := 0; i < 2; i++ {
+		info, err := p.Ping()
+		assert.Nil(t, err)
+		assert.True(t, info.HashMatch)
+	}
+	assert.Nil(t, p.BodyHasher)
+}
+
+// TestHappyEyeballs races a slow ipv6 against an ipv4 that only starts
+// after the head start, both fakes connect to the local server.
+func TestHappyEyeballs(t *testing.T) {
+	const v6Delay = 50 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	req, err := http.NewRequest(http.MethodGet, "http://dual.test:"+port, nil)
+	assert.Nil(t, err)
+	p := Pinger{
+		Req:           req,
+		HappyEyeballs: true,
+		Resolver: func(ctx context.Context, host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}, nil
+		},
+		Dialer: func(ctx context.Context, d *net.Dialer, address string) (net.Conn, error) {
+			if host, _, _ := net.SplitHostPort(address); host == "::1" {
+				time.Sleep(v6Delay)
+			}
+			return d.DialContext(ctx, "tcp", server.Listener.Addr().String())
+		},
+	}
+	info, err := p.Ping()
+	assert.Nil(t, err)
+	assert.Equal(t, "", info.Error)
+	assert.Equal(t, "ipv6", info.EyeballsWinner)
+	assert.True(t, info.EyeballsRaced)
+	// ipv4 would have connected faster, it only lost by its late start
+	assert.Less(t, info.EyeballsLeadMs, int64(0))
+	assert.Less(t, info.TotalTimeMs, connectionAttemptDelay.Milliseconds())
+}
+
+// TestWithRedirect checks that zero denies redirects, as -max-redirects 0 does.
+func TestWithRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/from" {
+			http.Redirect(w, r, "/to", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	ping := func(max int) *Info {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/from", nil)
+		assert.Nil(t, err)
+		info, err := PingWith(req, WithRedirect(max))
+		assert.Nil(t, err)
+		return info
+	}
+	info := ping(1)
+	assert.Equal(t, http.StatusOK, info.Code)
+	assert.Len(t, info.Rounds, 1)
+
+	info = ping(0)
+	assert.Equal(t, http.StatusFound, info.Code)
+	assert.Equal(t, "/to", info.RedirectLocation)
+	assert.NotEqual(t, "", info.Error)
+}
+
+// TestPingDone checks that the system ping comes apart from the Info returned.
+func TestPingDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	assert.Nil(t, err)
+	done := make(chan PingResult, 1)
+	info, err := PingWith(req, WithSysPing(true),
+		WithPingFunc(func(addr, srcAddr string, count int) (*command.PingOutput, error) {
+			return &command.PingOutput{Replies: []command.PingReply{{SequenceNumber: 1, TTL: 60}}}, nil
+		}),
+		WithPingDone(func(info *Info, ping PingResult) { done <- ping }))
+	assert.Nil(t, err)
+	r := <-done
+	assert.Equal(t, uint32(4), r.Hops)
+	assert.Equal(t, uint32(0), info.Hops)
+	r.Apply(info)
+	assert.Equal(t, uint32(4), info.Hops)
+}
+
+func TestPingErrorCode(t *testing.T) {
+	b, err := json.Marshal(Info{PingErrorCode: PingErrTimeout})
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"PingErrorCode":"timeout"`)
+	var info Info
+	assert.Nil(t, json.Unmarshal(b, &info))
+	assert.Equal(t, PingErrTimeout, info.PingErrorCode)
+	assert.Equal(t, "", PingErrorCode(0).String())
+
+	assert.Equal(t, PingErrPermissionDenied, pingErrorCode(&command.ExecError{ExitCode: 77}))
+	assert.Equal(t, PingErrOther, pingErrorCode(&command.ExecError{ExitCode: 1, Stderr: "ping: permission denied"}))
+}
@@ -0,0 +1,58 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+// proxyHeaders are added by proxies on the way, an origin answering
+// directly has no reason to send them back.
+var proxyHeaders = []string{"Via", "Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// A connection this slow from a host this few hops away is suspicious,
+// something near us likely terminates the tcp connection, or answers
+// the pings, on behalf of the server.
+const (
+	suspectMaxHops  = 2
+	suspectMinRttMs = 20
+)
+
+func headerIntermediary(header http.Header) []string {
+	var reasons []string
+	for _, name := range proxyHeaders {
+		if v := header.Get(name); v != "" {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", name, v))
+		}
+	}
+	return reasons
+}
+
+func hopsIntermediary(hops, rttMs uint32) string {
+	if hops == 0 || hops > suspectMaxHops || rttMs < suspectMinRttMs {
+		return ""
+	}
+	return fmt.Sprintf("%d hops away but %dms rtt", hops, rttMs)
+}
+
+// verifyPeer checks the certificate the handshake skipped, when VerifyHost
+// is off, so a certificate substituted on the way is still noticed.
+func (t *TcpWrapper) verifyPeer(state tls.ConnectionState, serverName string) string {
+	if t.verifyHost || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         t.rootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	if err != nil {
+		return "certificate: " + err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package http
+
+import "time"
+
+// Observer is told about each phase of a ping as soon as it finishes,
+// any of the hooks may be left nil.
+type Observer struct {
+	OnDNSDone   func(ip string, dnsTime time.Duration)
+	OnConnect   func(connectTime time.Duration)
+	OnTLSDone   func(tlsTime time.Duration)
+	OnFirstByte func(ttfb time.Duration)
+	OnComplete  func(info *Info)
+}
+
+func (o *Observer) dnsDone(ip string, d time.Duration) {
+	if o != nil && o.OnDNSDone != nil {
+		o.OnDNSDone(ip, d)
+	}
+}
+
+func (o *Observer) connected(d time.Duration) {
+	if o != nil && o.OnConnect != nil {
+		o.OnConnect(d)
+	}
+}
+
+func (o *Observer) tlsDone(d time.Duration) {
+	if o != nil && o.OnTLSDone != nil {
+		o.OnTLSDone(d)
+	}
+}
+
+func (o *Observer) firstByte(d time.Duration) {
+	if o != nil && o.OnFirstByte != nil {
+		o.OnFirstByte(d)
+	}
+}
+
+func (o *Observer) complete(info *Info) {
+	if o != nil && o.OnComplete != nil {
+		o.OnComplete(info)
+	}
+}
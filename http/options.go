@@ -0,0 +1,220 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"hash"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/qiniu/httpping/command"
+)
+
+// Option sets a field of the Pinger PingWith runs, each knob of the
+// Pinger but Req has one.
+type Option func(p *Pinger)
+
+// PingWith measures req with the options applied in order.
+func PingWith(req *http.Request, opts ...Option) (*Info, error) {
+	p := Pinger{Req: req}
+	for _, opt := range opts {
+		opt(&p)
+	}
+	return p.Ping()
+}
+
+func WithSysPing(ping bool) Option {
+	return func(p *Pinger) { p.SysPing = ping }
+}
+
+// WithSrcAddr binds to an ip, ip:port or interface name.
+func WithSrcAddr(addr string) Option {
+	return func(p *Pinger) { p.SrcAddr = addr }
+}
+
+func WithServerSupport(serverSupport bool) Option {
+	return func(p *Pinger) { p.ServerSupport = serverSupport }
+}
+
+func WithBodyHasher(hasher hash.Hash) Option {
+	return func(p *Pinger) { p.BodyHasher = hasher }
+}
+
+// WithTimeout bounds the whole request.
+func WithTimeout(timeout time.Duration) Option {
+	return func(p *Pinger) { p.Timeout = timeout }
+}
+
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(p *Pinger) { p.ConnectTimeout = timeout }
+}
+
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(p *Pinger) { p.ReadTimeout = timeout }
+}
+
+// WithRedirect follows up to max redirects, zero makes any redirect an
+// error like WithDenyRedirect, as -max-redirects 0 does.
+func WithRedirect(max int) Option {
+	return func(p *Pinger) {
+		p.Redirect = max > 0
+		p.MaxRedirects = max
+		p.DenyRedirect = max == 0
+	}
+}
+
+// WithDenyRedirect makes any redirect an error.
+func WithDenyRedirect() Option {
+	return func(p *Pinger) { p.DenyRedirect = true }
+}
+
+func WithServerIp(ip string) Option {
+	return func(p *Pinger) { p.ServerIp = ip }
+}
+
+func WithResolveOverrides(overrides map[string]string) Option {
+	return func(p *Pinger) { p.ResolveOverrides = overrides }
+}
+
+// WithTLS verifies the server against rootCAs, the system pool when nil,
+// and presents cert, when not nil, to a server asking for one.
+func WithTLS(verify bool, rootCAs *x509.CertPool, cert *tls.Certificate) Option {
+	return func(p *Pinger) {
+		p.VerifyHost = verify
+		p.RootCAs = rootCAs
+		p.ClientCert = cert
+	}
+}
+
+func WithServerName(name string) Option {
+	return func(p *Pinger) { p.ServerName = name }
+}
+
+func WithObserver(o *Observer) Option {
+	return func(p *Pinger) { p.Observer = o }
+}
+
+func WithReadBufferSize(size int) Option {
+	return func(p *Pinger) { p.ReadBufferSize = size }
+}
+
+// WithAcceptEncoding sends encoding as Accept-Encoding, "identity" asks for
+// an uncompressed body.
+func WithAcceptEncoding(encoding string) Option {
+	return func(p *Pinger) { p.AcceptEncoding = encoding }
+}
+
+func WithHttp10() Option {
+	return func(p *Pinger) { p.Http10 = true }
+}
+
+// WithPingDone returns without waiting for the system ping, done gets it.
+func WithPingDone(done func(info *Info, ping PingResult)) Option {
+	return func(p *Pinger) { p.PingDone = done }
+}
+
+func WithHappyEyeballs() Option {
+	return func(p *Pinger) { p.HappyEyeballs = true }
+}
+
+func WithDenyReserved() Option {
+	return func(p *Pinger) { p.DenyReserved = true }
+}
+
+// WithDoh resolves over DNS-over-HTTPS with the json api of url.
+func WithDoh(url string) Option {
+	return func(p *Pinger) { p.DohUrl = url }
+}
+
+func WithEnvProxy() Option {
+	return func(p *Pinger) { p.EnvProxy = true }
+}
+
+func WithTos(tos int) Option {
+	return func(p *Pinger) { p.Tos = tos }
+}
+
+func WithMaxConnDuration(d time.Duration) Option {
+	return func(p *Pinger) { p.MaxConnDuration = d }
+}
+
+func WithPcapFile(file string) Option {
+	return func(p *Pinger) { p.PcapFile = file }
+}
+
+// WithExpectedHash compares the hex hash of the body, sha256 unless
+// WithBodyHasher gives another.
+func WithExpectedHash(hash string) Option {
+	return func(p *Pinger) { p.ExpectedHash = hash }
+}
+
+func WithTLSSessionCache(cache tls.ClientSessionCache) Option {
+	return func(p *Pinger) { p.TLSSessionCache = cache }
+}
+
+// WithProgress calls progress each bytes of body or each interval,
+// DefaultProgressInterval when both are zero.
+func WithProgress(progress func(body int64, elapsed time.Duration), bytes int64, interval time.Duration) Option {
+	return func(p *Pinger) {
+		p.Progress = progress
+		p.ProgressBytes = bytes
+		p.ProgressInterval = interval
+	}
+}
+
+func WithPingCount(count int) Option {
+	return func(p *Pinger) { p.PingCount = count }
+}
+
+func WithDebug(d *Debug) Option {
+	return func(p *Pinger) { p.Debug = d }
+}
+
+// WithSuccessCodes sets the expected final status codes, 2xx when none.
+func WithSuccessCodes(codes ...int) Option {
+	return func(p *Pinger) { p.SuccessCodes = codes }
+}
+
+func WithGeoLookup(lookup func(ip net.IP) (GeoInfo, error)) Option {
+	return func(p *Pinger) { p.GeoLookup = lookup }
+}
+
+// WithResolver replaces the system resolver.
+func WithResolver(resolver func(ctx context.Context, host string) ([]net.IP, error)) Option {
+	return func(p *Pinger) { p.Resolver = resolver }
+}
+
+// WithDialer replaces the tcp dial.
+func WithDialer(dialer func(ctx context.Context, d *net.Dialer, address string) (net.Conn, error)) Option {
+	return func(p *Pinger) { p.Dialer = dialer }
+}
+
+// WithPingFunc replaces the system ping.
+func WithPingFunc(ping func(addr, srcAddr string, count int) (*command.PingOutput, error)) Option {
+	return func(p *Pinger) { p.PingFunc = ping }
+}
+
+// WithWaitClose waits up to d after the body for the server to close.
+func WithWaitClose(d time.Duration) Option {
+	return func(p *Pinger) { p.WaitClose = d }
+}
+
+// WithRetry makes the request again, up to retries times, while the code is
+// one of codes, backoff apart and doubling, DefaultRetryBackoff when zero.
+func WithRetry(retries int, backoff time.Duration, codes ...int) Option {
+	return func(p *Pinger) {
+		p.Retries = retries
+		p.RetryBackoff = backoff
+		p.RetryCodes = codes
+	}
+}
+
+// WithLocalPorts binds to the first free local port of from to to.
+func WithLocalPorts(from, to int) Option {
+	return func(p *Pinger) {
+		p.LocalPortFrom = from
+		p.LocalPortTo = to
+	}
+}
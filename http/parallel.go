@@ -0,0 +1,130 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parallel is a download split by Range over several connections,
+// the way download managers fetch, Speed is the aggregate.
+type Parallel struct {
+	Connections   int
+	ContentLength int64
+	BodySize      int64 // sum of the parts
+	TotalTimeMs   int64 // first connect to the last part done
+	Speed         float32
+	Parts         []*Info
+	Error         string // of the first part that failed
+}
+
+func (p *Parallel) String() string {
+	t, _ := json.MarshalIndent(p, "", "	")
+	return string(t)
+}
+
+// ErrNoRangeSupport is returned by PingParallel when the server
+// does not answer a range request with 206 and a known size.
+var ErrNoRangeSupport = errors.New("server does not support range requests")
+
+// PingParallel downloads the body in connections equal ranges at once, each on
+// its own connection. Comparing it to a single connection tells whether one
+// flow is held back by congestion control rather than by the link.
+// SysPing, BodyHasher, Progress, the Observer and Debug are not used for the
+// parts, each part is captured to its own file, like cap.1.pcap.
+func (p *Pinger) PingParallel(connections int) (*Parallel, error) {
+	err := p.normalizeURL()
+	if err != nil {
+		return nil, err
+	}
+	if connections < 1 {
+		connections = 1
+	}
+	length, err := p.contentLength()
+	if err != nil {
+		return nil, err
+	}
+	if int64(connections) > length {
+		connections = int(length)
+	}
+
+	r := &Parallel{Connections: connections, ContentLength: length, Parts: make([]*Info, connections)}
+	part := length / int64(connections)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < connections; i++ {
+		first, last := int64(i)*part, int64(i+1)*part-1
+		if i == connections-1 {
+			last = length - 1
+		}
+		sub := *p
+		sub.Req = cloneRequest(p.Req.Context(), p.Req)
+		sub.Req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+		sub.SysPing = false
+		sub.BodyHasher = nil
+		sub.ExpectedHash = ""
+		sub.Observer = nil
+		sub.Debug = nil
+		sub.PcapFile = pcapPart(p.PcapFile, strconv.Itoa(i+1))
+		sub.Progress = nil
+		sub.PingDone = nil
+		wg.Add(1)
+		go func(i int, sub Pinger) {
+			defer wg.Done()
+			info, err := sub.Ping()
+			if err != nil {
+				info = &Info{Error: err.Error()}
+			}
+			r.Parts[i] = info
+		}(i, sub)
+	}
+	wg.Wait()
+	r.TotalTimeMs = time.Since(start).Milliseconds()
+
+	for _, info := range r.Parts {
+		r.BodySize += info.BodySize
+		if info.Error != "" && r.Error == "" {
+			r.Error = info.Error
+		}
+	}
+	t := r.TotalTimeMs
+	if t <= 0 {
+		t = 1
+	}
+	r.Speed = float32(float64(r.BodySize) / float64(t))
+	return r, nil
+}
+
+// contentLength asks for the first byte only, the size comes back in Content-Range.
+func (p *Pinger) contentLength() (int64, error) {
+	w := p.newWrapper()
+	w.pcapFile = "" // only the parts are captured
+	defer w.Close()
+	req := cloneRequest(p.Req.Context(), p.Req)
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := p.newClient(w).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = readAll(resp.Body, nil, p.readBufferSize())
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, ErrNoRangeSupport
+	}
+	// bytes 0-0/12345
+	contentRange := resp.Header.Get("Content-Range")
+	i := strings.LastIndexByte(contentRange, '/')
+	if i < 0 {
+		return 0, ErrNoRangeSupport
+	}
+	length, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil || length <= 0 {
+		return 0, ErrNoRangeSupport
+	}
+	return length, nil
+}
@@ -0,0 +1,76 @@
+package http
+
+import (
+	"io"
+	"time"
+)
+
+// DefaultProgressInterval is how often Progress is called when
+// neither ProgressBytes nor ProgressInterval is set.
+const DefaultProgressInterval = time.Second
+
+// progressBody reports the body bytes read so far while the body is read,
+// elapsed counts from the start of the ping.
+type progressBody struct {
+	io.ReadCloser
+	fn       func(body int64, elapsed time.Duration)
+	start    time.Time
+	bytes    int64
+	interval time.Duration
+
+	total      int64
+	lastBytes  int64
+	lastReport time.Time
+	done       bool
+}
+
+func (p *Pinger) progressBody(body io.ReadCloser, start time.Time) io.ReadCloser {
+	if p.Progress == nil {
+		return body
+	}
+	interval := p.ProgressInterval
+	if interval <= 0 && p.ProgressBytes <= 0 {
+		interval = DefaultProgressInterval
+	}
+	return &progressBody{
+		ReadCloser: body,
+		fn:         p.Progress,
+		start:      start,
+		bytes:      p.ProgressBytes,
+		interval:   interval,
+		lastReport: time.Now(),
+	}
+}
+
+func (b *progressBody) Read(d []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(d)
+	b.total += int64(n)
+	now := time.Now()
+	if err != nil {
+		b.final(now)
+	} else if (b.bytes > 0 && b.total-b.lastBytes >= b.bytes) || (b.interval > 0 && now.Sub(b.lastReport) >= b.interval) {
+		b.report(now)
+	}
+	return
+}
+
+// Close reports the final count when the body was not read to the end.
+func (b *progressBody) Close() error {
+	b.final(time.Now())
+	return b.ReadCloser.Close()
+}
+
+// final is the one report of the end of the body, whatever was reported before.
+func (b *progressBody) final(now time.Time) {
+	if b.done {
+		return
+	}
+	b.done = true
+	b.report(now)
+}
+
+func (b *progressBody) report(now time.Time) {
+	b.lastBytes = b.total
+	b.lastReport = now
+	b.fn(b.total, now.Sub(b.start))
+}
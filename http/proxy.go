@@ -0,0 +1,35 @@
+package http
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"time"
+)
+
+// proxy is the proxy for req from HTTP_PROXY, HTTPS_PROXY and NO_PROXY,
+// nil when EnvProxy is not set or req goes direct.
+func (p *Pinger) proxy(req *http.Request) (*url.URL, error) {
+	if !p.EnvProxy || req == nil {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// proxyTrace times the tls handshake with the target, which the transport
+// runs itself inside the CONNECT tunnel instead of through DialTLS.
+func (t *TcpWrapper) proxyTrace() *httptrace.ClientTrace {
+	var start time.Time
+	return &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			start = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.tlsHandshake = time.Since(start)
+			t.observer.tlsDone(t.tlsHandshake)
+			t.firstRead = nil
+			t.firstWrite = nil
+		},
+	}
+}
@@ -0,0 +1,184 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Repeater pings the same request Count times, Interval apart,
+// and summarizes the runs.
+type Repeater struct {
+	Pinger   Pinger
+	Count    int
+	Interval time.Duration
+	// Jitter spreads each interval uniformly over Interval ± Jitter,
+	// so the pings do not run in lockstep with the server side.
+	Jitter time.Duration
+	// Buckets are the histogram upper bounds in ms, ascending,
+	// no histogram is kept when empty.
+	Buckets []uint32
+}
+
+func (r *Repeater) Do() *Stats {
+	if r.Count <= 0 {
+		return NewStats(r.Buckets)
+	}
+	return r.Run(r.Pinger.Req.Context(), nil)
+}
+
+// Run pings Count times, or until ctx is done when Count is zero, each
+// ping is passed to each, when not nil, along with the stats so far.
+// A ping cut short by ctx is not counted.
+func (r *Repeater) Run(ctx context.Context, each func(info *Info, stats *Stats)) *Stats {
+	stats := NewStats(r.Buckets)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; r.Count <= 0 || i < r.Count; i++ {
+		if i != 0 {
+			timer := time.NewTimer(r.interval(rnd))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return stats
+			}
+		}
+		info := r.once(ctx)
+		if ctx.Err() != nil {
+			return stats
+		}
+		stats.Add(info)
+		if each != nil {
+			each(info, stats)
+		}
+	}
+	return stats
+}
+
+func (r *Repeater) interval(rnd *rand.Rand) time.Duration {
+	if r.Jitter <= 0 {
+		return r.Interval
+	}
+	d := r.Interval - r.Jitter + time.Duration(rnd.Int63n(int64(2*r.Jitter)+1))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (r *Repeater) once(ctx context.Context) *Info {
+	p := r.Pinger
+	p.Req = cloneRequest(ctx, r.Pinger.Req)
+	info, err := p.Ping()
+	if err != nil {
+		info = &Info{Error: err.Error()}
+	}
+	return info
+}
+
+// maxSamples bounds the samples a Summary keeps for the percentiles, past
+// it they are a uniform sample of all the runs, a soak may run for days.
+const maxSamples = 10000
+
+// Summary describes one metric over the successful runs, the percentiles
+// are those of at most maxSamples of them.
+type Summary struct {
+	Min float64
+	Max float64
+	Avg float64
+	P50 float64
+	P95 float64
+	P99 float64
+	// Histogram counts the samples per bucket of Stats.Buckets,
+	// the extra last entry counts those above the last bound.
+	Histogram []uint32
+
+	count   int
+	sum     float64
+	samples []float64 // sorted
+}
+
+func (s *Summary) add(v float64, buckets []uint32) {
+	if s.count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.count++
+	s.sum += v
+	s.Avg = s.sum / float64(s.count)
+	if len(s.samples) < maxSamples {
+		s.insert(v)
+	} else if i := rand.Intn(s.count); i < maxSamples {
+		// reservoir sampling, each run is kept with the same chance
+		s.samples = append(s.samples[:i], s.samples[i+1:]...)
+		s.insert(v)
+	}
+	s.P50 = percentile(s.samples, 50)
+	s.P95 = percentile(s.samples, 95)
+	s.P99 = percentile(s.samples, 99)
+
+	if len(buckets) == 0 {
+		return
+	}
+	if s.Histogram == nil {
+		s.Histogram = make([]uint32, len(buckets)+1)
+	}
+	i := sort.Search(len(buckets), func(i int) bool { return v <= float64(buckets[i]) })
+	s.Histogram[i]++
+}
+
+// insert keeps the samples sorted.
+func (s *Summary) insert(v float64) {
+	i := sort.SearchFloat64s(s.samples, v)
+	s.samples = append(s.samples, 0)
+	copy(s.samples[i+1:], s.samples[i:])
+	s.samples[i] = v
+}
+
+// percentile uses the nearest rank of the sorted samples.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+type Stats struct {
+	Count              int
+	Errors             int
+	Buckets            []uint32
+	DnsTimeMs          Summary
+	ConnectTimeMs      Summary
+	TLSHandshakeTimeMs Summary
+	TtfbMs             Summary
+	TotalTimeMs        Summary
+}
+
+func NewStats(buckets []uint32) *Stats {
+	return &Stats{Buckets: buckets}
+}
+
+// Add counts one run, only runs without Error feed the summaries.
+func (s *Stats) Add(info *Info) {
+	s.Count++
+	if info.Error != "" {
+		s.Errors++
+		return
+	}
+	s.DnsTimeMs.add(float64(info.DnsTimeMs), s.Buckets)
+	s.ConnectTimeMs.add(float64(info.ConnectTimeMs), s.Buckets)
+	s.TLSHandshakeTimeMs.add(float64(info.TLSHandshakeTimeMs), s.Buckets)
+	s.TtfbMs.add(float64(info.TtfbMs), s.Buckets)
+	s.TotalTimeMs.add(float64(info.TotalTimeMs), s.Buckets)
+}
+
+func (s *Stats) String() string {
+	t, _ := json.MarshalIndent(s, "", "	")
+	return string(t)
+}
@@ -0,0 +1,65 @@
+package http
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// Resumption compares a full tls handshake with the resumed one of a
+// second connection, as clients coming back to a server pay it.
+type Resumption struct {
+	FullHandshakeMs    uint32
+	ResumedHandshakeMs uint32
+	Resumed            bool  // the server accepted the session, else the second handshake was full too
+	SavedMs            int64 // FullHandshakeMs - ResumedHandshakeMs
+	Error              string
+}
+
+// ErrNotTLS is returned by PingResumption for a plain http url.
+var ErrNotTLS = errors.New("tls session resumption needs an https url")
+
+// PingResumption pings the url twice on new connections sharing one session
+// cache. The requests are made in full, since tls 1.3 session tickets only
+// arrive after the handshake, SysPing is not run. With PcapFile each
+// connection is captured to its own file, like cap.full.pcap and cap.resumed.pcap.
+func (p *Pinger) PingResumption() (*Resumption, error) {
+	err := p.normalizeURL()
+	if err != nil {
+		return nil, err
+	}
+	if p.Req.URL.Scheme != "https" {
+		return nil, ErrNotTLS
+	}
+	cache := p.TLSSessionCache
+	if cache == nil {
+		cache = tls.NewLRUClientSessionCache(1)
+	}
+	once := func(part string) (*Info, error) {
+		sub := *p
+		sub.Req = cloneRequest(p.Req.Context(), p.Req)
+		sub.SysPing = false
+		sub.TLSSessionCache = cache
+		sub.PcapFile = pcapPart(p.PcapFile, part)
+		return sub.Ping()
+	}
+
+	var r Resumption
+	full, err := once("full")
+	if err != nil {
+		return nil, err
+	}
+	if full.Error != "" {
+		r.Error = full.Error
+		return &r, nil
+	}
+	resumed, err := once("resumed")
+	if err != nil {
+		return nil, err
+	}
+	r.FullHandshakeMs = full.TLSHandshakeTimeMs
+	r.ResumedHandshakeMs = resumed.TLSHandshakeTimeMs
+	r.Resumed = resumed.TLSResumed
+	r.SavedMs = int64(r.FullHandshakeMs) - int64(r.ResumedHandshakeMs)
+	r.Error = resumed.Error
+	return &r, nil
+}
@@ -0,0 +1,49 @@
+package http
+
+import "time"
+
+// DefaultRetryBackoff is the wait before the first retry when
+// Pinger.RetryBackoff is zero, it doubles with each retry.
+const DefaultRetryBackoff = time.Second
+
+func (p *Pinger) retryOn(code int) bool {
+	for _, c := range p.RetryCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// pingRetry repeats the whole request while the response code is one of
+// RetryCodes, the Info of the last attempt is returned with all the codes.
+func (p *Pinger) pingRetry() (*Info, error) {
+	backoff := p.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	ctx := p.Req.Context()
+	var codes []int
+	for attempt := 0; ; attempt++ {
+		sub := *p
+		sub.Req = cloneRequest(ctx, p.Req)
+		info, err := sub.ping()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, info.Code)
+		if attempt == p.Retries || !p.retryOn(info.Code) {
+			info.AttemptCodes = codes
+			return info, nil
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			info.AttemptCodes = codes
+			return info, nil
+		}
+		backoff *= 2
+	}
+}
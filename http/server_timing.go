@@ -0,0 +1,57 @@
+package http
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseServerTiming reads Server-Timing header values such as
+// `db;dur=53, cache;desc="Cache Read";dur=23.2` into name -> dur in ms,
+// a metric without dur is kept with 0.
+func parseServerTiming(values []string) map[string]float64 {
+	var timing map[string]float64
+	for _, v := range values {
+		for _, metric := range splitUnquoted(v, ',') {
+			params := splitUnquoted(metric, ';')
+			name := strings.TrimSpace(params[0])
+			if name == "" {
+				continue
+			}
+			var dur float64
+			for _, param := range params[1:] {
+				k, v, ok := strings.Cut(param, "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(k), "dur") {
+					continue
+				}
+				d, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(v), `"`), 64)
+				if err == nil {
+					dur = d
+				}
+			}
+			if timing == nil {
+				timing = make(map[string]float64)
+			}
+			timing[name] = dur
+		}
+	}
+	return timing
+}
+
+// splitUnquoted splits s at sep outside of double quoted strings.
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
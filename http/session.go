@@ -0,0 +1,113 @@
+package http
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session keeps its connection open between pings so that repeated probes
+// measure steady state latency instead of paying the handshakes each time.
+// The connection is redialed transparently once the server drops it.
+// Pings on a session are serialized, SysPing is not run by a session.
+type Session struct {
+	pinger Pinger
+	w      *TcpWrapper
+	client *http.Client
+	mutex  sync.Mutex
+
+	created  time.Time
+	requests atomic.Int64
+	bytes    atomic.Int64
+	errors   atomic.Int64
+}
+
+// SessionStats are the running totals of a session.
+type SessionStats struct {
+	Requests int64
+	Bytes    int64 // read from the connection, headers included
+	Errors   int64
+	Uptime   time.Duration
+}
+
+func NewSession(p Pinger) *Session {
+	s := &Session{pinger: p, created: time.Now()}
+	s.pinger.SysPing = false
+	s.w = s.pinger.newWrapper()
+	s.client = s.pinger.newClient(s.w)
+	return s
+}
+
+// Ping measures req, on the existing connection when it is still alive.
+func (s *Session) Ping(req *http.Request) (*Info, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.requests.Add(1)
+	info, err := s.ping(req)
+	if err != nil || info.Error != "" {
+		s.errors.Add(1)
+	}
+	if info != nil {
+		s.bytes.Add(info.TotalSize)
+	}
+	return info, err
+}
+
+func (s *Session) ping(req *http.Request) (*Info, error) {
+	p := s.pinger
+	p.Req = req
+	err := p.normalizeURL()
+	if err != nil {
+		return nil, err
+	}
+
+	httpInfo := Info{StartTime: time.Now()}
+	prevConnect := s.w.connectStart
+	s.w.resetCounters()
+	s.w.ipHost = req.URL.Hostname()
+	p.Debug.reset()
+	s.w.debug = p.Debug
+	hasher := p.bodyHasher()
+	start := time.Now()
+	err = p.do(&httpInfo, s.w, s.client, hasher)
+	s.w.stopCounting()
+	p.Debug.finish(s.w)
+	if !prevConnect.IsZero() && s.w.connectStart == prevConnect {
+		httpInfo.Reused = true
+		httpInfo.DnsTimeMs = 0
+		httpInfo.ConnectTimeMs = 0
+		httpInfo.TLSHandshakeTimeMs = 0
+	} else {
+		start = s.w.connectStart
+	}
+	if err != nil && httpInfo.Code == 0 {
+		p.Observer.complete(&httpInfo)
+		return &httpInfo, nil
+	}
+
+	finish(&httpInfo, s.w, start)
+	p.waitClose(&httpInfo, s.w)
+	recordLead(&httpInfo, s.w)
+	p.recordHash(&httpInfo, hasher)
+	p.Observer.complete(&httpInfo)
+	return &httpInfo, nil
+}
+
+// Stats may be called while pings are running.
+func (s *Session) Stats() SessionStats {
+	return SessionStats{
+		Requests: s.requests.Load(),
+		Bytes:    s.bytes.Load(),
+		Errors:   s.errors.Load(),
+		Uptime:   time.Since(s.created),
+	}
+}
+
+func (s *Session) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.client.CloseIdleConnections()
+	_ = s.w.Close()
+}
@@ -0,0 +1,59 @@
+package http
+
+import (
+	"fmt"
+	"strings"
+)
+
+const waterfallWidth = 50
+
+// Waterfall draws the phases of the request one after the other,
+// each bar starts where the previous phase ended:
+//
+//	dns           12ms ███
+//	connect       30ms    ███████
+//	tls           45ms           ███████████
+//	ttfb          80ms                      ████████████████████
+//	download      33ms                                          █████████
+//	total        200ms
+func (h *Info) Waterfall() string {
+	phases := []struct {
+		name string
+		ms   int64
+	}{
+		{"dns", int64(h.DnsTimeMs)},
+		{"connect", int64(h.ConnectTimeMs)},
+		{"tls", int64(h.TLSHandshakeTimeMs)},
+		{"ttfb", int64(h.TtfbMs)},
+		{"download", h.DownloadTimeMs},
+	}
+	var sum int64
+	for _, p := range phases {
+		sum += p.ms
+	}
+	scale := sum
+	if h.TotalTimeMs > scale {
+		scale = h.TotalTimeMs
+	}
+	if scale == 0 {
+		scale = 1
+	}
+
+	var b strings.Builder
+	var at int64
+	for _, p := range phases {
+		start := int(at * waterfallWidth / scale)
+		end := int((at + p.ms) * waterfallWidth / scale)
+		if end == start && p.ms > 0 {
+			end++
+		}
+		at += p.ms
+		line := fmt.Sprintf("%-9s %6dms %s%s", p.name, p.ms, strings.Repeat(" ", start), strings.Repeat("█", end-start))
+		b.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+	fmt.Fprintf(&b, "%-9s %6dms\n", "total", h.TotalTimeMs)
+	if h.Error != "" {
+		fmt.Fprintf(&b, "error: %s\n", h.Error)
+	}
+	return b.String()
+}
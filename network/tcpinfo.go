@@ -12,6 +12,32 @@ type TCPInfo struct {
 	TotalPackets      uint32
 }
 
+// TCPExtInfo holds the client side counters that are not part of TCPInfo,
+// TCPInfo is sent as is by servers and cannot grow.
+type TCPExtInfo struct {
+	SegsOut     uint64
+	SegsIn      uint64
+	DataSegsOut uint64 // segments with payload, without the handshake and pure acks
+	DataSegsIn  uint64
+	SndMss      uint32
+	RcvMss      uint32 // estimated from the segments received, 0 where unknown
+}
+
+// ExtInfo picks TCPExtInfo from the raw struct of GetSockoptTCPInfo.
+func ExtInfo(raw interface{}) *TCPExtInfo {
+	switch t := raw.(type) {
+	case *TCPInfoLinux:
+		return &TCPExtInfo{SegsOut: uint64(t.Tcpi_segs_out), SegsIn: uint64(t.Tcpi_segs_in),
+			DataSegsOut: uint64(t.Tcpi_data_segs_out), DataSegsIn: uint64(t.Tcpi_data_segs_in),
+			SndMss: t.Tcpi_snd_mss, RcvMss: t.Tcpi_rcv_mss}
+	case *TCPInfoMac:
+		// darwin only counts packets, acks included, the data segments stay
+		// zero rather than passing the acks off as data
+		return &TCPExtInfo{SegsOut: t.Tcpi_txpackets, SegsIn: t.Tcpi_rxpackets, SndMss: t.Tcpi_maxseg}
+	}
+	return &TCPExtInfo{}
+}
+
 // go struct for low version linux kernel
 //type TCPInfoLinux struct {
 //	State          uint8
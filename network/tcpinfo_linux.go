@@ -3,6 +3,7 @@
 package network
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"syscall"
@@ -36,3 +37,34 @@ func GetSockoptTCPInfo(tcpConn *net.TCPConn) (*TCPInfo, interface{}, error) {
 
 	return tcpInfo.common(), &tcpInfo, nil
 }
+
+// GetCongestionControl reads the congestion control algorithm of the
+// connection, like "cubic" or "bbr", with TCP_CONGESTION.
+func GetCongestionControl(tcpConn *net.TCPConn) (string, error) {
+	if tcpConn == nil {
+		return "", fmt.Errorf("tcp conn is nil")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", fmt.Errorf("error getting raw connection. err=%v", err)
+	}
+
+	var name [16]byte // TCP_CA_NAME_MAX
+	size := uint32(len(name))
+	var errno syscall.Errno
+	err = rawConn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP, syscall.TCP_CONGESTION,
+			uintptr(unsafe.Pointer(&name[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return "", fmt.Errorf("rawconn control failed. err=%v", err)
+	}
+	if errno != 0 {
+		return "", fmt.Errorf("syscall failed. errno=%d", errno)
+	}
+	n := bytes.IndexByte(name[:size], 0)
+	if n < 0 {
+		n = int(size)
+	}
+	return string(name[:n]), nil
+}
@@ -38,3 +38,8 @@ func GetSockoptTCPInfo(tcpConn *net.TCPConn) (*TCPInfo, interface{}, error) {
 
 	return tcpInfo.common(), &tcpInfo, nil
 }
+
+// GetCongestionControl is not available on darwin, it has no TCP_CONGESTION.
+func GetCongestionControl(tcpConn *net.TCPConn) (string, error) {
+	return "", nil
+}
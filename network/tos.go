@@ -0,0 +1,28 @@
+package network
+
+import (
+	"net"
+	"syscall"
+)
+
+// TOSControl returns a net.Dialer Control that sets the IP TOS byte, the
+// traffic class for ipv6, so the SYN already carries the marking.
+// The DSCP is the upper six bits, DSCP 46 (EF) is tos 184.
+func TOSControl(tos int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+				level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+			}
+		}
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), level, opt, tos)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
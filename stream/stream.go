@@ -113,6 +113,4 @@ func (p *Prober) do(client Client) (*StreamInfo, error) {
 
 		player.ch <- *pkt
 	}
-
-	return player.info, nil
 }